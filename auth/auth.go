@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/go-pkgz/rest"
 	"github.com/mikhail-angelov/websignal/logger"
@@ -18,7 +19,8 @@ type Auth struct {
 	conf      oauth2.Config
 	providers []*Auth2Provider
 	log       *logger.Log
-	url       string // root url for the rest service, i.e. http://blah.example.com, required
+	url       string   // root url for the rest service, i.e. http://blah.example.com, required
+	Avatars   *Avatars // identicons of users without picture url
 }
 
 type loginRequest1 struct {
@@ -29,9 +31,10 @@ type loginRequest1 struct {
 //NewAuth constructor
 func NewAuth(jwtSectret string, log *logger.Log, url string) *Auth {
 	return &Auth{
-		jwt: NewJWT(jwtSectret),
-		log: log,
-		url: url,
+		jwt:     NewJWT(jwtSectret),
+		log:     log,
+		url:     url,
+		Avatars: NewAvatars(""),
 	}
 }
 
@@ -66,12 +69,14 @@ func (a *Auth) Handlers() (authHandler http.Handler) {
 				rest.RenderJSON(w, r, rest.JSON{"error": err.Error()})
 				return
 			}
+			if claims.User == nil {
+				// invite token is signed by the same secret
+				w.WriteHeader(http.StatusUnauthorized)
+				rest.RenderJSON(w, r, rest.JSON{"error": "no user info presented in the claim"})
+				return
+			}
 			if claims.User.PictureURL == "" {
-				pic, err := GenerateAvatar(claims.User.Email)
-				if err != nil {
-					log.Printf("failed to gen avatar %v", err)
-				}
-				claims.User.Picture = pic
+				claims.User.PictureURL = a.Avatars.URL(*claims.User)
 			}
 			rest.RenderJSON(w, r, claims.User)
 			return
@@ -147,18 +152,28 @@ func (a *Auth) ValidateToken(tokenString string) (*User, error) {
 	if a.jwt.IsExpired(claims) {
 		return nil, errors.Wrap(err, "token expired")
 	}
+
+	if claims.User == nil {
+		return nil, errors.New("no user info presented in the claim")
+	}
 	log.Printf("success auth  %v", claims.User.ID)
 	if claims.User.PictureURL == "" {
-		pic, err := GenerateAvatar(claims.User.Email)
-		if err != nil {
-			log.Printf("failed to gen avatar %v", err)
-		}
-		claims.User.Picture = pic
+		claims.User.PictureURL = a.Avatars.URL(*claims.User)
 	}
 
 	return claims.User, nil
 }
 
+// InviteToken makes signed invite token to the room
+func (a *Auth) InviteToken(invite Invite, ttl time.Duration) (string, error) {
+	return a.jwt.InviteToken(invite, ttl)
+}
+
+// ParseInvite verifies invite token and returns the invite
+func (a *Auth) ParseInvite(tokenString string) (*Invite, error) {
+	return a.jwt.ParseInvite(tokenString)
+}
+
 // refreshExpiredToken makes a new token with passed claims
 func (a *Auth) refreshExpiredToken(w http.ResponseWriter, claims Claims, tkn string) (Claims, error) {
 
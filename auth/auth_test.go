@@ -8,7 +8,9 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/mikhail-angelov/websignal/logger"
@@ -121,3 +123,39 @@ func TestAddProvider(t *testing.T) {
 	auth.AddProvider("yandex", "test", "test")
 	assert.Equal(t, 2, len(auth.providers))
 }
+
+func TestInviteToken(t *testing.T) {
+	a := NewAuth("test", logger.New(), "http://localhost:9004")
+	invite := Invite{ID: "invite", RoomID: "room", MaxUses: 2, Role: "viewer"}
+	token, err := a.InviteToken(invite, time.Minute)
+	require.Nil(t, err)
+	parsed, err := a.ParseInvite(token)
+	require.Nil(t, err)
+	assert.Equal(t, invite, *parsed)
+
+	// invite cannot be used for login
+	_, err = a.ValidateToken(token)
+	assert.NotNil(t, err)
+	res := httptest.NewRecorder()
+	a.Handlers().ServeHTTP(res, httptest.NewRequest("GET", "/auth/user?token="+token, nil))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+
+	// login token is not invite
+	login, err := a.jwt.Token(Claims{User: &User{ID: "test"}})
+	require.Nil(t, err)
+	_, err = a.ParseInvite(login)
+	assert.EqualError(t, err, "no invite presented in the claim")
+
+	token, err = a.InviteToken(invite, 0)
+	require.Nil(t, err)
+	_, err = a.ParseInvite(token)
+	assert.Nil(t, err)
+
+	expired, err := a.jwt.Token(Claims{Invite: &invite, StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix()}})
+	require.Nil(t, err)
+	_, err = a.ParseInvite(expired)
+	assert.EqualError(t, err, "invite expired")
+
+	_, err = NewAuth("other", logger.New(), "").ParseInvite(token)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// avatarMaxAge is Cache-Control max age of avatar response, avatar of the user never changes
+const avatarMaxAge = 24 * 60 * 60
+
+// Avatars renders identicons of users once and serves them by user id,
+// rendered avatars are kept in memory and in the directory if it is set
+type Avatars struct {
+	Path string // url path of the avatars handler
+	dir  string
+
+	mu        sync.Mutex
+	seeds     map[string]string // user id -> identicon seed, only known users are rendered
+	cache     map[string]avatar
+	rendering map[string]*rendering // avatars which are being loaded or rendered outside the lock
+	generate  func(seed string) ([]byte, error)
+}
+
+// rendering is avatar in progress, concurrent requests of the same user wait for it
+type rendering struct {
+	done chan struct{}
+	av   *avatar
+	err  error
+}
+
+type avatar struct {
+	png  []byte
+	etag string
+}
+
+// NewAvatars creates avatars service, avatars are cached on disk in dir, it is created if it does not exist,
+// empty dir keeps them in memory only
+func NewAvatars(dir string) *Avatars {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Printf("[WARN] can't create avatars directory %s, %v", dir, err)
+			dir = ""
+		}
+	}
+	return &Avatars{Path: "/avatar", dir: dir, seeds: map[string]string{}, cache: map[string]avatar{},
+		rendering: map[string]*rendering{}, generate: GenerateAvatar}
+}
+
+// URL registers the user and returns url of its avatar
+func (a *Avatars) URL(user User) string {
+	seed := user.Email
+	if seed == "" {
+		seed = user.ID
+	}
+	a.mu.Lock()
+	a.seeds[user.ID] = seed
+	a.mu.Unlock()
+	return a.Path + "/" + url.PathEscape(user.ID)
+}
+
+// ServeHTTP serves avatar of the user id which is the last element of the url path
+func (a *Avatars) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := url.PathUnescape(path.Base(r.URL.Path))
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	av, err := a.get(id)
+	if err != nil {
+		log.Printf("[WARN] failed to get avatar of %s, %v", id, err)
+		http.Error(w, "failed to render avatar", http.StatusInternalServerError)
+		return
+	}
+	if av == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", avatarMaxAge))
+	w.Header().Set("ETag", av.etag)
+	if r.Header.Get("If-None-Match") == av.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if _, err := w.Write(av.png); err != nil {
+		log.Printf("[WARN] failed to send avatar of %s, %v", id, err)
+	}
+}
+
+// get returns cached avatar of the user, it is rendered on the first call,
+// returns nil for unknown user without cached avatar,
+// avatar is rendered once without the lock, concurrent requests of the same user wait for it
+func (a *Avatars) get(id string) (*avatar, error) {
+	a.mu.Lock()
+	if av, ok := a.cache[id]; ok {
+		a.mu.Unlock()
+		return &av, nil
+	}
+	if r, ok := a.rendering[id]; ok {
+		a.mu.Unlock()
+		<-r.done
+		return r.av, r.err
+	}
+	seed, known := a.seeds[id]
+	r := &rendering{done: make(chan struct{})}
+	a.rendering[id] = r
+	a.mu.Unlock()
+
+	r.av, r.err = a.render(id, seed, known)
+	a.mu.Lock()
+	if r.av != nil {
+		a.cache[id] = *r.av
+	}
+	delete(a.rendering, id)
+	a.mu.Unlock()
+	close(r.done)
+	return r.av, r.err
+}
+
+// render loads avatar from the file or renders it for the known user and saves it to the file
+func (a *Avatars) render(id string, seed string, known bool) (*avatar, error) {
+	file := a.file(id)
+	png, err := a.read(file)
+	if png == nil {
+		if !known {
+			return nil, err
+		}
+		if png, err = a.generate(seed); err != nil {
+			return nil, err
+		}
+		if file != "" {
+			if err := ioutil.WriteFile(file, png, 0600); err != nil {
+				log.Printf("[WARN] can't save avatar of %s, %v", id, err)
+			}
+		}
+	}
+	sum := sha1.Sum(png)
+	return &avatar{png: png, etag: `"` + hex.EncodeToString(sum[:]) + `"`}, nil
+}
+
+// read returns avatar from the file, nil if there is no file
+func (a *Avatars) read(file string) ([]byte, error) {
+	if file == "" {
+		return nil, nil
+	}
+	png, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "can't read avatar %s", file)
+	}
+	return png, nil
+}
+
+// file returns avatar file of the user, user ids may have any characters so they are hashed
+func (a *Avatars) file(id string) string {
+	if a.dir == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(id))
+	return filepath.Join(a.dir, hex.EncodeToString(sum[:])+".png")
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/mikhail-angelov/websignal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getAvatarT(t *testing.T, ts *httptest.Server, url string, etag string) *http.Response {
+	req, err := http.NewRequest("GET", ts.URL+url, nil)
+	require.Nil(t, err)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	return res
+}
+
+func TestAvatars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avatars")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	avatars := NewAvatars(dir)
+	router := chi.NewRouter()
+	router.Get(avatars.Path+"/{userID}", avatars.ServeHTTP)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	res := getAvatarT(t, ts, "/avatar/local_test", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	url := avatars.URL(User{ID: "local_test@mail.com", Email: "test@mail.com"})
+	assert.Equal(t, "/avatar/local_test@mail.com", url)
+	res = getAvatarT(t, ts, url, "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	assert.Equal(t, "public, max-age=86400", res.Header.Get("Cache-Control"))
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	png, err := ioutil.ReadAll(res.Body)
+	require.Nil(t, err)
+	res.Body.Close()
+	expected, err := GenerateAvatar("test@mail.com")
+	require.Nil(t, err)
+	assert.Equal(t, expected, png)
+
+	res = getAvatarT(t, ts, url, etag)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Equal(t, etag, res.Header.Get("ETag"))
+
+	// rendered avatar is served from disk after restart
+	files, _ := filepath.Glob(filepath.Join(dir, "*.png"))
+	assert.Len(t, files, 1)
+	router = chi.NewRouter()
+	restarted := NewAvatars(dir)
+	router.Get(restarted.Path+"/{userID}", restarted.ServeHTTP)
+	ts2 := httptest.NewServer(router)
+	defer ts2.Close()
+	res = getAvatarT(t, ts2, url, etag)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+}
+
+func TestValidateTokenPictureURL(t *testing.T) {
+	a := NewAuth("test", logger.New(), "http://localhost:9004")
+	expires := jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()}
+	token, err := a.jwt.Token(Claims{User: &User{ID: "test", Email: "test@mail.com"}, StandardClaims: expires})
+	require.Nil(t, err)
+	user, err := a.ValidateToken(token)
+	require.Nil(t, err)
+	assert.Equal(t, "/avatar/test", user.PictureURL)
+
+	token, err = a.jwt.Token(Claims{User: &User{ID: "github", PictureURL: "https://avatars/github"}, StandardClaims: expires})
+	require.Nil(t, err)
+	user, err = a.ValidateToken(token)
+	require.Nil(t, err)
+	assert.Equal(t, "https://avatars/github", user.PictureURL)
+}
+
+func TestAvatarsRenderOnce(t *testing.T) {
+	avatars := NewAvatars("")
+	var (
+		calls   int32
+		release = make(chan struct{})
+	)
+	avatars.generate = func(seed string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return GenerateAvatar(seed)
+	}
+	avatars.URL(User{ID: "user", Email: "user@mail.com"})
+
+	var wg sync.WaitGroup
+	results := make([]*avatar, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = avatars.get("user")
+		}(i)
+	}
+	// rendering does not block other users
+	done := make(chan struct{})
+	go func() {
+		avatars.URL(User{ID: "other"})
+		avatars.get("unknown")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("avatars are locked while rendering")
+	}
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, av := range results {
+		require.NotNil(t, av)
+		assert.Equal(t, results[0].etag, av.etag)
+	}
+}
@@ -18,6 +18,7 @@ type Claims struct {
 	User        *User      `json:"user,omitempty"` // user info
 	SessionOnly bool       `json:"sess_only,omitempty"`
 	Handshake   *Handshake `json:"handshake,omitempty"` // used for oauth handshake
+	Invite      *Invite    `json:"invite,omitempty"`    // used for room invites, not for login
 }
 
 type Handshake struct {
@@ -26,6 +27,14 @@ type Handshake struct {
 	ID    string `json:"id,omitempty"`
 }
 
+//Invite grants access to private room
+type Invite struct {
+	ID      string `json:"id"`
+	RoomID  string `json:"room"`
+	MaxUses int    `json:"max_uses,omitempty"` // 0 means unlimited
+	Role    string `json:"role,omitempty"`
+}
+
 //JWT service
 type JWT struct {
 	jwtSectret string
@@ -182,6 +191,32 @@ func (j *JWT) Token(claims Claims) (string, error) {
 	return tokenString, nil
 }
 
+// InviteToken makes invite token, zero ttl makes token without expiration
+func (j *JWT) InviteToken(invite Invite, ttl time.Duration) (string, error) {
+	claims := Claims{Invite: &invite}
+	claims.Issuer = Issuer
+	claims.Id = invite.ID
+	if ttl > 0 {
+		claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+	return j.Token(claims)
+}
+
+// ParseInvite verifies invite token, expired tokens are rejected
+func (j *JWT) ParseInvite(tokenString string) (*Invite, error) {
+	claims, err := j.Parse(tokenString)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get invite")
+	}
+	if claims.Invite == nil {
+		return nil, errors.New("no invite presented in the claim")
+	}
+	if claims.ExpiresAt != 0 && j.IsExpired(claims) {
+		return nil, errors.New("invite expired")
+	}
+	return claims.Invite, nil
+}
+
 func randToken() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -23,7 +23,6 @@ type User struct {
 	// set by service
 	Name       string `json:"name"`
 	ID         string `json:"id"`
-	Picture    []byte `json:"picture,omitempty"`
 	PictureURL string `json:"pictureUrl,omitempty"`
 	Audience   string `json:"aud,omitempty"`
 
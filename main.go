@@ -1,7 +1,9 @@
 package main
 
 import (
+	"log"
 	"os"
+	"time"
 
 	"github.com/mikhail-angelov/websignal/server"
 )
@@ -16,7 +18,23 @@ func main() {
 		jwtSectret = "tsjwt"
 	}
 	s := &server.Server{
-		Port: port,
+		Port:            port,
+		DataDir:         os.Getenv("DATA_DIR"),
+		RoomIdleTTL:     envDuration("ROOM_IDLE_TTL"),
+		RoomMaxLifetime: envDuration("ROOM_MAX_LIFETIME"),
 	}
 	s.Run(jwtSectret)
 }
+
+// envDuration parses duration like 30m from the environment variable, it is 0 if the variable is not set
+func envDuration(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("[ERROR] invalid %s %q: %v", name, value, err)
+	}
+	return d
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errMessageNotFound = errors.New("message is not found")
+
+// maxReactions limits number of distinct emoji reactions of a message
+const maxReactions = 20
+
+//AddDirectMessage stores private message of the author peer to the user of the room,
+//it is not a part of the room history and is visible to its author and recipient only
+func (r *RoomService) AddDirectMessage(roomID string, message RoomMessage) (RoomMessage, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return RoomMessage{}, err
+	}
+	defer e.Unlock()
+	if !hasRole(peerRole(&e.room, message.Author), chatRole) {
+		return RoomMessage{}, errForbidden
+	}
+	if isMuted(&e.room, message.Author, mediaChat) {
+		return RoomMessage{}, errMuted
+	}
+	if userRole(&e.room, message.To) == "" {
+		return RoomMessage{}, errors.Wrapf(errNotMember, "recipient %s", message.To)
+	}
+	if message.To == userOfPeer(&e.room, message.Author) {
+		return RoomMessage{}, errors.Wrap(errForbidden, "direct message to yourself")
+	}
+	message.ReplyTo = 0
+	message = e.stamp(message)
+	e.direct = append(e.direct, message)
+	r.persist(e)
+	return message, nil
+}
+
+//GetDirectMessages returns page of direct messages between the user connected to the room and the other user,
+//the page is selected like in GetMessages
+func (r *RoomService) GetDirectMessages(roomID string, userID string, with string, before int64, after int64, limit int) ([]RoomMessage, bool, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer e.Unlock()
+	if userRole(&e.room, userID) == "" {
+		log.Printf("%s is not allowed to read messages of room %s", userID, roomID)
+		return nil, false, errForbidden
+	}
+	direct := []RoomMessage{}
+	for _, m := range e.direct {
+		if (m.AuthorID == userID && m.To == with) || (m.AuthorID == with && m.To == userID) {
+			direct = append(direct, m)
+		}
+	}
+	messages, hasMore := pageMessages(direct, before, after, limit)
+	return messages, hasMore, nil
+}
+
+//EditMessage replaces text of the message, the author only may edit it
+func (r *RoomService) EditMessage(roomID string, peerID string, id int64, text string) (RoomMessage, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return RoomMessage{}, err
+	}
+	defer e.Unlock()
+	i, err := e.findLiveMessage(id)
+	if err != nil {
+		return RoomMessage{}, err
+	}
+	message := &e.room.Messages[i]
+	if !hasRole(peerRole(&e.room, peerID), chatRole) || message.AuthorID == "" || message.AuthorID != userOfPeer(&e.room, peerID) {
+		log.Printf("%s is not allowed to edit message %d in room %s", peerID, id, roomID)
+		return RoomMessage{}, errForbidden
+	}
+	if isMuted(&e.room, peerID, mediaChat) {
+		return RoomMessage{}, errMuted
+	}
+	message.Text = text
+	message.Edited = time.Now().UTC().Format(time.RFC3339Nano)
+	edited := *message
+	r.persist(e)
+	return edited, nil
+}
+
+//DeleteMessage removes the message from the room history, the author or room managers may delete it,
+//thread root with replies is replaced by tombstone which is removed with the last reply
+func (r *RoomService) DeleteMessage(roomID string, peerID string, id int64) (*Room, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	i, err := e.findLiveMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	authorID := e.room.Messages[i].AuthorID
+	userID := userOfPeer(&e.room, peerID)
+	if !hasRole(peerRole(&e.room, peerID), manageRole) && (authorID == "" || authorID != userID) {
+		log.Printf("%s is not allowed to delete message %d in room %s", peerID, id, roomID)
+		return nil, errForbidden
+	}
+	message := e.room.Messages[i]
+	if e.hasReplies(id) {
+		e.room.Messages[i] = RoomMessage{ID: id, Timestamp: message.Timestamp, Time: message.Time, Deleted: true}
+		r.persist(e)
+		return e.snapshot(), nil
+	}
+	e.removeMessage(id)
+	if message.ReplyTo != 0 && !e.hasReplies(message.ReplyTo) {
+		if j, err := e.findMessage(message.ReplyTo); err == nil && e.room.Messages[j].Deleted {
+			e.removeMessage(message.ReplyTo)
+		}
+	}
+	r.persist(e)
+	return e.snapshot(), nil
+}
+
+// hasReplies returns true if the message is a thread root
+func (e *roomEntry) hasReplies(id int64) bool {
+	for _, m := range e.room.Messages {
+		if m.ReplyTo == id {
+			return true
+		}
+	}
+	return false
+}
+
+// removeMessage removes the message from the room history, the slice is copied since snapshots share it
+func (e *roomEntry) removeMessage(id int64) {
+	messages := make([]RoomMessage, 0, len(e.room.Messages))
+	for _, m := range e.room.Messages {
+		if m.ID != id {
+			messages = append(messages, m)
+		}
+	}
+	e.room.Messages = messages
+}
+
+//GetThread returns the root message and its replies to the user connected to the room
+func (r *RoomService) GetThread(roomID string, userID string, id int64) ([]RoomMessage, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	if userRole(&e.room, userID) == "" {
+		log.Printf("%s is not allowed to read messages of room %s", userID, roomID)
+		return nil, errForbidden
+	}
+	i, err := e.findMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	if root := e.room.Messages[i].ReplyTo; root != 0 {
+		id = root
+	}
+	thread := []RoomMessage{}
+	for _, m := range e.room.Messages {
+		if m.ID == id || m.ReplyTo == id {
+			thread = append(thread, m)
+		}
+	}
+	return thread, nil
+}
+
+//ToggleReaction adds reaction of the peer user to the message or removes it if the user has already reacted with the emoji,
+//returns true if the reaction is added
+func (r *RoomService) ToggleReaction(roomID string, peerID string, id int64, emoji string) (*Room, bool, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer e.Unlock()
+	if !hasRole(peerRole(&e.room, peerID), chatRole) {
+		log.Printf("%s is not allowed to react in room %s", peerID, roomID)
+		return nil, false, errForbidden
+	}
+	if isMuted(&e.room, peerID, mediaChat) {
+		return nil, false, errMuted
+	}
+	i, err := e.findLiveMessage(id)
+	if err != nil {
+		return nil, false, err
+	}
+	userID := userOfPeer(&e.room, peerID)
+	message := &e.room.Messages[i]
+	// reactions are copied, snapshots share them
+	reactions := map[string][]string{}
+	for k, users := range message.Reactions {
+		if k != emoji {
+			reactions[k] = users
+		}
+	}
+	users := []string{}
+	for _, u := range message.Reactions[emoji] {
+		if u != userID {
+			users = append(users, u)
+		}
+	}
+	added := len(users) == len(message.Reactions[emoji])
+	if added && len(users) == 0 && len(reactions) >= maxReactions {
+		return nil, false, errors.Wrapf(errForbidden, "message has %d reactions", maxReactions)
+	}
+	if added {
+		users = append(users, userID)
+	}
+	if len(users) > 0 {
+		reactions[emoji] = users
+	}
+	message.Reactions = nil
+	if len(reactions) > 0 {
+		message.Reactions = reactions
+	}
+	r.persist(e)
+	return e.snapshot(), added, nil
+}
+
+// stamp sets id, author and time of the new message
+func (e *roomEntry) stamp(message RoomMessage) RoomMessage {
+	now := time.Now().UTC()
+	e.lastID++
+	message.ID = e.lastID
+	message.AuthorID = userOfPeer(&e.room, message.Author)
+	message.Timestamp = now.Format(time.RFC3339Nano)
+	message.Time = now.UnixNano() / int64(time.Millisecond)
+	message.Edited = ""
+	message.Reactions = nil
+	return message
+}
+
+// pageMessages selects page of messages ordered by id, see GetMessages
+func pageMessages(all []RoomMessage, before int64, after int64, limit int) ([]RoomMessage, bool) {
+	if limit <= 0 || limit > maxMessagesPage {
+		limit = maxMessagesPage
+	}
+	messages := []RoomMessage{}
+	for _, m := range all {
+		if m.ID > after && (before == 0 || m.ID < before) {
+			messages = append(messages, m)
+		}
+	}
+	if len(messages) <= limit {
+		return messages, false
+	}
+	if after > 0 {
+		return messages[:limit], true
+	}
+	return messages[len(messages)-limit:], true
+}
+
+// findMessage returns index of the message in the room history
+func (e *roomEntry) findMessage(id int64) (int, error) {
+	for i, m := range e.room.Messages {
+		if m.ID == id {
+			return i, nil
+		}
+	}
+	return 0, errors.Wrapf(errMessageNotFound, "message %d", id)
+}
+
+// findLiveMessage returns index of the message in the room history, tombstones are not found
+func (e *roomEntry) findLiveMessage(id int64) (int, error) {
+	i, err := e.findMessage(id)
+	if err == nil && e.room.Messages[i].Deleted {
+		return 0, errors.Wrapf(errMessageNotFound, "message %d is deleted", id)
+	}
+	return i, err
+}
+
+// userOfPeer returns user id of the room peer, empty if the peer is not in the room
+func userOfPeer(room *Room, peerID string) string {
+	for _, u := range room.Users {
+		if u.PeerID != "" && u.PeerID == peerID {
+			return u.ID
+		}
+	}
+	return ""
+}
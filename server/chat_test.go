@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEditDeleteMessage(t *testing.T) {
+	rooms := NewRoomService()
+	room, _ := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer"}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "b", PeerID: "b-peer"}, "")
+	room, err := rooms.AddMessage(room.ID, RoomMessage{Author: "a-peer", Text: "hi"})
+	require.NoError(t, err)
+	message := room.Messages[0]
+	assert.Equal(t, "a", message.AuthorID)
+	created, err := time.Parse(time.RFC3339Nano, message.Timestamp)
+	require.NoError(t, err)
+	assert.Equal(t, created.UnixNano()/int64(time.Millisecond), message.Time)
+
+	_, err = rooms.EditMessage(room.ID, "b-peer", message.ID, "bye")
+	assert.Equal(t, errForbidden, err)
+	_, err = rooms.EditMessage(room.ID, "a-peer", 100, "bye")
+	assert.Equal(t, errMessageNotFound, errors.Cause(err))
+	edited, err := rooms.EditMessage(room.ID, "a-peer", message.ID, "bye")
+	require.NoError(t, err)
+	assert.Equal(t, "bye", edited.Text)
+	assert.NotEmpty(t, edited.Edited)
+	assert.Equal(t, message.Timestamp, edited.Timestamp)
+	assert.Equal(t, "bye", rooms.GetRoom(room.ID).Messages[0].Text)
+
+	_, err = rooms.DeleteMessage(room.ID, "b-peer", message.ID)
+	assert.Equal(t, errForbidden, err)
+	room, _ = rooms.AddMessage(room.ID, RoomMessage{Author: "b-peer", Text: "hi"})
+	room, err = rooms.DeleteMessage(room.ID, "b-peer", room.Messages[1].ID)
+	require.NoError(t, err)
+	assert.Len(t, room.Messages, 1)
+	// moderators may delete any message
+	room, err = rooms.DeleteMessage(room.ID, "owner-peer", message.ID)
+	require.NoError(t, err)
+	assert.Empty(t, room.Messages)
+	_, err = rooms.DeleteMessage(room.ID, "owner-peer", message.ID)
+	assert.Equal(t, errMessageNotFound, errors.Cause(err))
+}
+
+func TestThreadsAndReactions(t *testing.T) {
+	rooms := NewRoomService()
+	room, _ := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer"}, "")
+	room, _ = rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "root"})
+	root := room.Messages[0].ID
+	rooms.AddMessage(room.ID, RoomMessage{Author: "a-peer", Text: "other"})
+	room, err := rooms.AddMessage(room.ID, RoomMessage{Author: "a-peer", Text: "reply", ReplyTo: root})
+	require.NoError(t, err)
+	reply := room.Messages[2]
+	assert.Equal(t, root, reply.ReplyTo)
+	// reply to the reply belongs to the root thread
+	room, _ = rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "reply 2", ReplyTo: reply.ID})
+	assert.Equal(t, root, room.Messages[3].ReplyTo)
+	_, err = rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "reply", ReplyTo: 100})
+	assert.Equal(t, errMessageNotFound, errors.Cause(err))
+
+	thread, err := rooms.GetThread(room.ID, "a", reply.ID)
+	require.NoError(t, err)
+	require.Len(t, thread, 3)
+	assert.Equal(t, []string{"root", "reply", "reply 2"}, []string{thread[0].Text, thread[1].Text, thread[2].Text})
+	_, err = rooms.GetThread(room.ID, "stranger", root)
+	assert.Equal(t, errForbidden, err)
+
+	room, added, err := rooms.ToggleReaction(room.ID, "a-peer", root, "👍")
+	require.NoError(t, err)
+	assert.True(t, added)
+	before := room.Messages[0].Reactions
+	room, _, _ = rooms.ToggleReaction(room.ID, "owner-peer", root, "👍")
+	assert.Equal(t, map[string][]string{"👍": {"a", "owner"}}, room.Messages[0].Reactions)
+	assert.Equal(t, map[string][]string{"👍": {"a"}}, before)
+	room, added, _ = rooms.ToggleReaction(room.ID, "a-peer", root, "👍")
+	assert.False(t, added)
+	room, _, _ = rooms.ToggleReaction(room.ID, "owner-peer", root, "👍")
+	assert.Nil(t, room.Messages[0].Reactions)
+	_, _, err = rooms.ToggleReaction(room.ID, "stranger", root, "👍")
+	assert.Equal(t, errForbidden, err)
+
+	for i := 0; i < maxReactions; i++ {
+		_, _, err = rooms.ToggleReaction(room.ID, "a-peer", root, fmt.Sprintf("e%d", i))
+		require.NoError(t, err)
+	}
+	_, _, err = rooms.ToggleReaction(room.ID, "owner-peer", root, "👍")
+	assert.Equal(t, errForbidden, errors.Cause(err))
+	// existing reactions may be toggled
+	room, added, err = rooms.ToggleReaction(room.ID, "owner-peer", root, "e0")
+	require.NoError(t, err)
+	assert.True(t, added)
+	assert.Len(t, room.Messages[0].Reactions, maxReactions)
+}
+
+func TestDeleteThreadRoot(t *testing.T) {
+	rooms := NewRoomService()
+	room, _ := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer"}, "")
+	room, _ = rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "root"})
+	root := room.Messages[0].ID
+	rooms.ToggleReaction(room.ID, "a-peer", root, "👍")
+	room, _ = rooms.AddMessage(room.ID, RoomMessage{Author: "a-peer", Text: "reply", ReplyTo: root})
+	reply := room.Messages[1].ID
+
+	// root with replies is kept as tombstone
+	room, err := rooms.DeleteMessage(room.ID, "owner-peer", root)
+	require.NoError(t, err)
+	require.Len(t, room.Messages, 2)
+	tombstone := room.Messages[0]
+	assert.True(t, tombstone.Deleted)
+	assert.Empty(t, tombstone.Text)
+	assert.Empty(t, tombstone.AuthorID)
+	assert.Nil(t, tombstone.Reactions)
+	thread, err := rooms.GetThread(room.ID, "a", reply)
+	require.NoError(t, err)
+	require.Len(t, thread, 2)
+	assert.Equal(t, root, thread[0].ID)
+	_, err = rooms.EditMessage(room.ID, "owner-peer", root, "edit")
+	assert.Equal(t, errMessageNotFound, errors.Cause(err))
+	_, _, err = rooms.ToggleReaction(room.ID, "a-peer", root, "👍")
+	assert.Equal(t, errMessageNotFound, errors.Cause(err))
+	_, err = rooms.DeleteMessage(room.ID, "owner-peer", root)
+	assert.Equal(t, errMessageNotFound, errors.Cause(err))
+
+	// tombstone is removed with the last reply
+	room, err = rooms.DeleteMessage(room.ID, "a-peer", reply)
+	require.NoError(t, err)
+	assert.Empty(t, room.Messages)
+}
+
+func TestDirectMessages(t *testing.T) {
+	rooms := NewRoomService()
+	room, _ := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer"}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "b", PeerID: "b-peer"}, "")
+	rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "public"})
+
+	direct, err := rooms.AddDirectMessage(room.ID, RoomMessage{Author: "a-peer", Text: "secret", To: "b"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), direct.ID)
+	assert.Equal(t, "a", direct.AuthorID)
+	rooms.AddDirectMessage(room.ID, RoomMessage{Author: "b-peer", Text: "reply", To: "a"})
+	rooms.AddDirectMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "other", To: "a"})
+	_, err = rooms.AddDirectMessage(room.ID, RoomMessage{Author: "a-peer", Text: "hi", To: "none"})
+	assert.Equal(t, errNotMember, errors.Cause(err))
+	_, err = rooms.AddDirectMessage(room.ID, RoomMessage{Author: "a-peer", Text: "hi", To: "a"})
+	assert.Equal(t, errForbidden, errors.Cause(err))
+	assert.Len(t, rooms.GetRoom(room.ID).Messages, 1)
+
+	messages, hasMore, err := rooms.GetDirectMessages(room.ID, "b", "a", 0, 0, 10)
+	require.NoError(t, err)
+	assert.False(t, hasMore)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "secret", messages[0].Text)
+	assert.Equal(t, "reply", messages[1].Text)
+	messages, _, _ = rooms.GetDirectMessages(room.ID, "owner", "b", 0, 0, 10)
+	assert.Empty(t, messages)
+	_, _, err = rooms.GetDirectMessages(room.ID, "stranger", "a", 0, 0, 10)
+	assert.Equal(t, errForbidden, err)
+}
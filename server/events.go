@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// kinds of ephemeral room events
+const (
+	eventTyping     = "typing"
+	eventStopTyping = "stopTyping"
+	eventRaiseHand  = "raiseHand"
+	eventLowerHand  = "lowerHand"
+	eventCustom     = "custom" // application event, it has name and data
+)
+
+const (
+	defaultEventRate  = 5  // events per second
+	defaultEventBurst = 10 // events
+)
+
+// throttle is token bucket limiting events of the connection
+type throttle struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if there is one, the bucket is refilled with rate tokens per second up to burst
+func (t *throttle) allow(now time.Time, rate float64, burst int) bool {
+	if t.last.IsZero() {
+		t.tokens = float64(burst)
+	} else {
+		t.tokens += now.Sub(t.last).Seconds() * rate
+		if t.tokens > float64(burst) {
+			t.tokens = float64(burst)
+		}
+	}
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// handleEvent broadcasts ephemeral event of the peer to the other peers of the room, events are never stored
+func (s *WsServer) handleEvent(from *WS, socketID string, payload EventPayload) error {
+	if payload.Kind == eventCustom && payload.Name == "" {
+		return newProtocolError(codeBadMessage, "name is required for custom event")
+	}
+	if s.EventRate > 0 && !from.events.allow(time.Now(), s.EventRate, s.EventBurst) {
+		atomic.AddUint64(&s.stats.Throttled, 1)
+		return newProtocolError(codeRateLimited, "too many events, limit is %v per second", s.EventRate)
+	}
+	room := s.rooms.GetRoom(payload.RoomID)
+	if room == nil {
+		return roomError(errRoomNotFound, "event error, room %s", payload.RoomID)
+	}
+	if !hasUser(room.Users, socketID) {
+		return roomError(errNotMember, "event error, room %s", payload.RoomID)
+	}
+	event := RoomEventPayload{RoomID: room.ID, PeerID: socketID, Kind: payload.Kind, Name: payload.Name, Data: payload.Data}
+	return s.sendToRoom(room, &Message{From: socketID, Type: eventMessage, Data: composeData(event)}, socketID)
+}
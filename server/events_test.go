@@ -0,0 +1,65 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle(t *testing.T) {
+	th := throttle{}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.True(t, th.allow(now, 2, 3))
+	}
+	assert.False(t, th.allow(now, 2, 3))
+	assert.True(t, th.allow(now.Add(500*time.Millisecond), 2, 3))
+	assert.False(t, th.allow(now.Add(500*time.Millisecond), 2, 3))
+	// bucket is not refilled over burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, th.allow(now, 2, 3))
+	}
+	assert.False(t, th.allow(now, 2, 3))
+}
+
+func TestRoomEvents(t *testing.T) {
+	s, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.EventRate = 1
+	wsServer.EventBurst = 2
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	peer := dialWsT(t, s, "user", "peer")
+	defer peer.Close()
+	require.Nil(t, writeWsT(peer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer"}))
+	readTypeWsT(t, peer, roomUpdateMessage)
+
+	require.Nil(t, writeWsT(peer, eventMessage, map[string]interface{}{"id": roomID, "kind": "typing"}))
+	event := readTypeWsT(t, owner, eventMessage)
+	assert.Equal(t, map[string]interface{}{"roomId": roomID, "peerId": "peer", "kind": "typing"}, event)
+	require.Nil(t, writeWsT(peer, eventMessage, map[string]interface{}{"id": roomID, "kind": "custom", "name": "poll", "data": map[string]interface{}{"q": 1}}))
+	event = readTypeWsT(t, owner, eventMessage)
+	assert.Equal(t, map[string]interface{}{"q": float64(1)}, event["data"])
+	require.Nil(t, writeWsT(peer, eventMessage, map[string]interface{}{"id": roomID, "kind": "raiseHand"}))
+	e := readTypeWsT(t, peer, errorMessage)
+	assert.Equal(t, codeRateLimited, e["code"])
+	assert.Equal(t, uint64(1), wsServer.Stats().Throttled)
+	assert.Empty(t, rooms.GetRoom(roomID).Messages)
+
+	require.Nil(t, writeWsT(owner, eventMessage, map[string]interface{}{"id": roomID, "kind": "custom"}))
+	e = readTypeWsT(t, owner, errorMessage)
+	assert.Equal(t, codeBadMessage, e["code"])
+	require.Nil(t, writeWsT(owner, eventMessage, map[string]interface{}{"id": roomID, "kind": "dance"}))
+	e = readTypeWsT(t, owner, errorMessage)
+	assert.Equal(t, codeBadMessage, e["code"])
+	other := dialWsT(t, s, "other", "other-peer")
+	defer other.Close()
+	require.Nil(t, writeWsT(other, eventMessage, map[string]interface{}{"id": roomID, "kind": "typing"}))
+	e = readTypeWsT(t, other, errorMessage)
+	assert.Equal(t, codeNotMember, e["code"])
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// lobby states of the knocking peer, see lobbyMessage
+const (
+	lobbyWaiting  = "waiting"
+	lobbyAdmitted = "admitted"
+	lobbyDenied   = "denied"
+)
+
+//Admit moves the peer from the lobby to the room, by user has to manage the room
+func (r *RoomService) Admit(roomID string, by string, peerID string) (*Room, error) {
+	return r.decide(roomID, by, peerID, func(e *roomEntry, user User) error {
+		if e.isFull() {
+			return errRoomFull
+		}
+		user.Role = roleParticipant
+		e.room.Users = append(e.room.Users, user)
+		return nil
+	})
+}
+
+//Deny removes the peer from the lobby, by user has to manage the room
+func (r *RoomService) Deny(roomID string, by string, peerID string) (*Room, error) {
+	return r.decide(roomID, by, peerID, func(e *roomEntry, user User) error {
+		return nil
+	})
+}
+
+//LeaveLobbies removes the peer from all lobbies, returns updated rooms
+func (r *RoomService) LeaveLobbies(peerID string) []Room {
+	updated := []Room{}
+	for _, e := range r.entries() {
+		e.Lock()
+		if !e.closed && hasUser(e.room.Pending, peerID) {
+			e.room.Pending = filterUsers(e.room.Pending, func(u User) bool { return u.PeerID != peerID })
+			r.persist(e)
+			updated = append(updated, *e.snapshot())
+		}
+		e.Unlock()
+	}
+	return updated
+}
+
+// decide removes the peer from the lobby and applies fn to it
+func (r *RoomService) decide(roomID string, by string, peerID string, fn func(e *roomEntry, user User) error) (*Room, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	if !hasRole(userRole(&e.room, by), manageRole) {
+		log.Printf("%s is not allowed to manage lobby of room %s", by, roomID)
+		return nil, errForbidden
+	}
+	for _, u := range e.room.Pending {
+		if u.PeerID != peerID {
+			continue
+		}
+		if err := fn(e, u); err != nil {
+			return nil, err
+		}
+		e.room.Pending = filterUsers(e.room.Pending, func(u User) bool { return u.PeerID != peerID })
+		r.persist(e)
+		return e.snapshot(), nil
+	}
+	return nil, errors.Wrapf(errNotMember, "peer %s is not in the lobby", peerID)
+}
+
+// knock puts the user to the lobby, the previous knock of the peer is replaced
+func (e *roomEntry) knock(user User) {
+	e.room.Pending = filterUsers(e.room.Pending, func(u User) bool { return u.PeerID != user.PeerID })
+	e.room.Pending = append(e.room.Pending, user)
+}
+
+// managers returns peers which manage the room
+func managers(room *Room) []string {
+	peers := []string{}
+	for _, u := range room.Users {
+		if u.PeerID != "" && hasRole(u.Role, manageRole) {
+			peers = append(peers, u.PeerID)
+		}
+	}
+	return peers
+}
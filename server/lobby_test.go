@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLobby(t *testing.T) {
+	rooms := NewRoomService()
+	room, err := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{Lobby: true, MaxUsers: 2}, "")
+	require.NoError(t, err)
+
+	room, err = rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer", Name: "A"}, "")
+	require.NoError(t, err)
+	assert.False(t, hasUser(room.Users, "a-peer"))
+	assert.Equal(t, []User{{ID: "a", PeerID: "a-peer", Name: "A"}}, room.Pending)
+	rooms.JoinToRoom(room.ID, User{ID: "b", PeerID: "b-peer"}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "c", PeerID: "c-peer"}, "")
+	// owner does not wait in the lobby
+	room, err = rooms.JoinToRoom(room.ID, User{ID: "owner", PeerID: "owner-peer2"}, "")
+	require.NoError(t, err)
+	assert.True(t, hasUser(room.Users, "owner-peer2"))
+	rooms.LeaveRoom(room.ID, "owner-peer2")
+
+	_, err = rooms.Admit(room.ID, "a", "a-peer")
+	require.Equal(t, errForbidden, err)
+	_, err = rooms.Admit(room.ID, "owner", "none")
+	require.Equal(t, errNotMember, errors.Cause(err))
+	room, err = rooms.Admit(room.ID, "owner", "a-peer")
+	require.NoError(t, err)
+	assert.Equal(t, roleParticipant, peerRole(room, "a-peer"))
+	assert.Len(t, room.Pending, 2)
+	// admitted peer does not wait again on repeated join
+	room, err = rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer", Name: "A"}, "")
+	require.NoError(t, err)
+	assert.True(t, hasUser(room.Users, "a-peer"))
+	assert.False(t, hasUser(room.Pending, "a-peer"))
+	_, err = rooms.Admit(room.ID, "owner", "b-peer")
+	require.Equal(t, errRoomFull, err)
+
+	room, err = rooms.Deny(room.ID, "owner", "b-peer")
+	require.NoError(t, err)
+	assert.False(t, hasUser(room.Users, "b-peer"))
+	assert.Len(t, room.Pending, 1)
+
+	updated := rooms.LeaveLobbies("c-peer")
+	require.Len(t, updated, 1)
+	assert.Empty(t, updated[0].Pending)
+	assert.Empty(t, rooms.LeaveLobbies("c-peer"))
+}
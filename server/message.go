@@ -1,6 +1,11 @@
 package server
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
 
 const (
 	textMessage                int = 0
@@ -15,15 +20,314 @@ const (
 	startPeerConnectionMessage     = 9
 	addFakeUser                    = 10
 	removeFakeUser                 = 11
+	sessionMessage                 = 12
+	peerStateMessage               = 13
+	errorMessage                   = 14
+	ackMessage                     = 15
+	helloMessage                   = 16
+	stopPeerConnectionMessage      = 17
+	transferOwnershipMessage       = 18
+	kickMessage                    = 19
+	banMessage                     = 20
+	muteMessage                    = 21
+	moderationMessage              = 22
+	setRoleMessage                 = 23
+	lobbyMessage                   = 24
+	admitMessage                   = 25
+	denyMessage                    = 26
+	editMessage                    = 27
+	deleteMessage                  = 28
+	reactionMessage                = 29
+	eventMessage                   = 30
+	roomClosedMessage              = 31
+	roomChangeMessage              = 32
+	syncRoomMessage                = 33
+	roomClosingMessage             = 34
+)
+
+// error codes of errorMessage
+const (
+	codeBadMessage         = "bad_message"         // message or its data cannot be parsed or is invalid
+	codeTooLarge           = "too_large"           // message exceeds size limit
+	codeUnknownType        = "unknown_type"        // message type is not supported
+	codeUnsupportedVersion = "unsupported_version" // protocol version requested in hello is not supported
+	codeRoomNotFound       = "room_not_found"      // room does not exist
+	codeNotOwner           = "not_owner"           // action is allowed to the room owner only
+	codeNotMember          = "not_member"          // peer is not in the room
+	codePeerNotFound       = "peer_not_found"      // addressed peer is not connected
+	codeInviteRequired     = "invite_required"     // room is private and no invite is presented
+	codeInvalidInvite      = "invalid_invite"      // invite is malformed, expired, revoked or used up
+	codeWrongPassword      = "wrong_password"      // room password does not match
+	codeRoomFull           = "room_full"           // room has no free places
+	codeForbidden          = "forbidden"           // action is not allowed to the role of the peer in the room
+	codeBanned             = "banned"              // user is banned in the room
+	codeMuted              = "muted"               // chat of the peer is muted by moderator
+	codeMessageNotFound    = "message_not_found"   // chat message does not exist or is deleted
+	codeRateLimited        = "rate_limited"        // peer sends messages too often
+	codeInternal           = "internal"            // unexpected server error
+)
+
+// peer connection states, see peerStateMessage
+const (
+	peerReconnecting = "reconnecting"
+	peerReconnected  = "reconnected"
 )
 
 // Message (ws) fields
 type Message struct {
-	From string          `json:"from"`
-	To   string          `json:"to"`
-	Type int             `json:"type"`
-	Data json.RawMessage `json:"data"`
+	From      string          `json:"from" validate:"max=64"`
+	To        string          `json:"to" validate:"max=64"`
+	Type      int             `json:"type"`
+	RequestID string          `json:"requestId,omitempty" validate:"max=64"` // optional, set by client and echoed in ack or error
+	Data      json.RawMessage `json:"data"`
+}
+
+// HelloPayload is data of helloMessage, client sends the highest version it supports,
+// server replies with the negotiated version and common capabilities
+type HelloPayload struct {
+	Version        int      `json:"version"`
+	Capabilities   []string `json:"capabilities,omitempty" validate:"max=32"`
+	MaxMessageSize int64    `json:"maxMessageSize,omitempty"` // set by server
+}
+
+// TextPayload is data of textMessage sent by client
+type TextPayload struct {
+	RoomID  string `json:"id" validate:"required,max=64"`
+	Text    string `json:"text" validate:"required,max=4096"`
+	ReplyTo int64  `json:"replyTo,omitempty"`              // optional, id of the replied message
+	To      string `json:"to,omitempty" validate:"max=64"` // optional, user id of direct message recipient
+}
+
+// EditMessagePayload is data of editMessage sent by client, server sends edited RoomMessage to the room
+type EditMessagePayload struct {
+	RoomID    string `json:"id" validate:"required,max=64"`
+	MessageID int64  `json:"messageId" validate:"required"`
+	Text      string `json:"text" validate:"required,max=4096"`
+}
+
+// DeleteMessagePayload is data of deleteMessage, server sends it to the room as is,
+// deleted thread root stays in the history as tombstone while it has replies
+type DeleteMessagePayload struct {
+	RoomID    string `json:"id" validate:"required,max=64"`
+	MessageID int64  `json:"messageId" validate:"required"`
+}
+
+// ReactionPayload is data of reactionMessage sent by client, it toggles reaction of the user to the message
+type ReactionPayload struct {
+	RoomID    string `json:"id" validate:"required,max=64"`
+	MessageID int64  `json:"messageId" validate:"required"`
+	Emoji     string `json:"emoji" validate:"required,max=32"`
+}
+
+// ReactionEventPayload is data of reactionMessage sent by server to the room
+type ReactionEventPayload struct {
+	RoomID    string `json:"roomId"`
+	MessageID int64  `json:"messageId"`
+	Emoji     string `json:"emoji"`
+	UserID    string `json:"userId"`
+	Added     bool   `json:"added"` // false if the reaction is removed
+}
+
+// EventPayload is data of eventMessage sent by client, the event is sent to the other peers of the room and never stored
+type EventPayload struct {
+	RoomID string          `json:"id" validate:"required,max=64"`
+	Kind   string          `json:"kind" validate:"required,oneof=typing stopTyping raiseHand lowerHand custom"`
+	Name   string          `json:"name,omitempty" validate:"max=64"`   // custom event only
+	Data   json.RawMessage `json:"data,omitempty" validate:"max=1024"` // custom event only
+}
+
+// RoomEventPayload is data of eventMessage sent by server
+type RoomEventPayload struct {
+	RoomID string          `json:"roomId"`
+	PeerID string          `json:"peerId"`
+	Kind   string          `json:"kind"`
+	Name   string          `json:"name,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// RoomClosedPayload is data of roomClosedMessage, it is sent to the room peers when server closes the room
+type RoomClosedPayload struct {
+	RoomID string `json:"roomId"`
+	Reason string `json:"reason"` // idle, expired or deleted
+}
+
+// RoomClosingPayload is data of roomClosingMessage, it is sent to the room peers before server closes the room
+type RoomClosingPayload struct {
+	RoomID   string `json:"roomId"`
+	Reason   string `json:"reason"`   // expired
+	Deadline string `json:"deadline"` // RFC3339 time of closing
+}
+
+// SyncRoomPayload is data of syncRoomMessage, client which missed room change reports its room version,
+// server replies with room snapshot if the version is not the current one
+type SyncRoomPayload struct {
+	RoomID  string `json:"id" validate:"required,max=64"`
+	Version int64  `json:"version" validate:"min=0"`
+}
+
+// CreateRoomPayload is data of createRoomMessage
+type CreateRoomPayload struct {
+	Settings RoomSettings `json:"settings"`
+	Password string       `json:"password,omitempty" validate:"max=72"` // optional, required to join the room, bcrypt uses 72 bytes
+}
+
+// JoinRoomPayload is data of joinRoomMessage
+type JoinRoomPayload struct {
+	RoomID   string `json:"id" validate:"required,max=64"`
+	PeerID   string `json:"peerId" validate:"required,max=64"`
+	Invite   string `json:"invite,omitempty" validate:"max=2048"` // invite token, required to join private room
+	Password string `json:"password,omitempty" validate:"max=72"`
+}
+
+// LeaveRoomPayload is data of leaveRoomMessage
+type LeaveRoomPayload struct {
+	RoomID string `json:"id" validate:"required,max=64"`
 }
 
-// InputMessageData generic input/output data format
-type InputMessageData map[string]string
+// TransferOwnershipPayload is data of transferOwnershipMessage, owner hands the room over to the peer,
+// or only designates it as successor which takes the room over when the owner leaves
+type TransferOwnershipPayload struct {
+	RoomID    string `json:"id" validate:"required,max=64"`
+	PeerID    string `json:"peerId" validate:"required,max=64"`
+	Successor bool   `json:"successor,omitempty"`
+}
+
+// ModeratePayload is data of kickMessage and banMessage, peer is removed from the room,
+// ban prevents the user of the peer from joining the room again,
+// it is data of admitMessage and denyMessage as well, they let the peer from the lobby in or out
+type ModeratePayload struct {
+	RoomID string `json:"id" validate:"required,max=64"`
+	PeerID string `json:"peerId" validate:"required,max=64"`
+}
+
+// MutePayload is data of muteMessage, muted false unmutes the media
+type MutePayload struct {
+	RoomID string   `json:"id" validate:"required,max=64"`
+	PeerID string   `json:"peerId" validate:"required,max=64"`
+	Media  []string `json:"media" validate:"required,max=3,oneof=audio video chat"`
+	Muted  bool     `json:"muted"`
+}
+
+// ModerationPayload is data of moderationMessage, it is sent to the room and the moderated peer,
+// muted peer has to stop its audio or video
+type ModerationPayload struct {
+	RoomID string   `json:"roomId"`
+	Action string   `json:"action"`
+	By     string   `json:"by"` // id of moderator user
+	PeerID string   `json:"peerId,omitempty"`
+	UserID string   `json:"userId,omitempty"`
+	Media  []string `json:"media,omitempty"`
+}
+
+// LobbyPayload is data of lobbyMessage, it is sent to the knocking peer and room managers
+type LobbyPayload struct {
+	RoomID string `json:"roomId"`
+	State  string `json:"state"`
+	User   User   `json:"user"`
+}
+
+// SetRolePayload is data of setRoleMessage
+type SetRolePayload struct {
+	RoomID string `json:"id" validate:"required,max=64"`
+	PeerID string `json:"peerId" validate:"required,max=64"`
+	Role   string `json:"role" validate:"required,oneof=moderator participant viewer"`
+}
+
+// FakeUserPayload is data of addFakeUser and removeFakeUser
+type FakeUserPayload struct {
+	RoomID     string `json:"roomId" validate:"required,max=64"`
+	ID         string `json:"id" validate:"required,max=64"`
+	Name       string `json:"name,omitempty" validate:"max=128"`
+	PictureURL string `json:"pictureUrl,omitempty" validate:"max=1024"`
+}
+
+// SDPPayload is data of sdpMessage, it is forwarded to the peer as is
+type SDPPayload struct {
+	Type string `json:"type" validate:"required,max=16"`
+	SDP  string `json:"sdp" validate:"required"`
+}
+
+// CandidatePayload is data of candidateMessage, it is forwarded to the peer as is, null means end of candidates
+type CandidatePayload struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *int    `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+// PeerPayload is data of startPeerConnectionMessage and stopPeerConnectionMessage,
+// receiver of start message initiates connection to the peer, receiver of stop message closes it
+type PeerPayload struct {
+	PeerID string `json:"peerId"`
+}
+
+// SessionPayload is data of sessionMessage, it is the first message of every connection
+type SessionPayload struct {
+	ID          string `json:"id"`
+	ResumeToken string `json:"resumeToken"`
+	Resumed     bool   `json:"resumed"`
+}
+
+// PeerStatePayload is data of peerStateMessage
+type PeerStatePayload struct {
+	PeerID string `json:"peerId"`
+	State  string `json:"state"`
+}
+
+// ErrorPayload is data of errorMessage
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Type    int    `json:"type"` // type of failed message
+}
+
+// AckPayload is data of ackMessage
+type AckPayload struct {
+	Type int `json:"type"` // type of acknowledged message
+}
+
+// ProtocolError is reported to the peer with errorMessage
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newProtocolError(code string, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// roomError converts room service error to protocol error
+func roomError(err error, format string, args ...interface{}) *ProtocolError {
+	message := fmt.Sprintf(format, args...) + ": " + err.Error()
+	switch err.(type) {
+	case notOwnerError:
+		return &ProtocolError{Code: codeNotOwner, Message: message}
+	}
+	switch errors.Cause(err) {
+	case errRoomNotFound:
+		return &ProtocolError{Code: codeRoomNotFound, Message: message}
+	case errNotMember:
+		return &ProtocolError{Code: codeNotMember, Message: message}
+	case errInviteRequired:
+		return &ProtocolError{Code: codeInviteRequired, Message: message}
+	case errInvalidInvite:
+		return &ProtocolError{Code: codeInvalidInvite, Message: message}
+	case errWrongPassword:
+		return &ProtocolError{Code: codeWrongPassword, Message: message}
+	case errRoomFull:
+		return &ProtocolError{Code: codeRoomFull, Message: message}
+	case errForbidden:
+		return &ProtocolError{Code: codeForbidden, Message: message}
+	case errBanned:
+		return &ProtocolError{Code: codeBanned, Message: message}
+	case errMuted:
+		return &ProtocolError{Code: codeMuted, Message: message}
+	case errMessageNotFound:
+		return &ProtocolError{Code: codeMessageNotFound, Message: message}
+	}
+	return &ProtocolError{Code: codeInternal, Message: message}
+}
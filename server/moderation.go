@@ -0,0 +1,158 @@
+package server
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// media which can be muted by moderator, server rejects chat messages and session descriptions
+// which send muted media, the client stops muted tracks on moderation event
+const (
+	mediaAudio = "audio"
+	mediaVideo = "video"
+	mediaChat  = "chat"
+)
+
+// moderation actions
+const (
+	actionKick   = "kick"
+	actionBan    = "ban"
+	actionUnban  = "unban"
+	actionMute   = "mute"
+	actionUnmute = "unmute"
+)
+
+var (
+	errForbidden = errors.New("action is not allowed to the role")
+	errBanned    = errors.New("user is banned in the room")
+	errMuted     = errors.New("is muted in the room")
+)
+
+//Kick removes the peer from the room, by is id of the owner or moderator user
+func (r *RoomService) Kick(roomID string, by string, peerID string) (*Room, error) {
+	return r.moderate(roomID, by, peerID, func(e *roomEntry, target User) {
+		e.removePeers(func(u User) bool { return u.PeerID == peerID })
+	})
+}
+
+//Ban removes all peers of the user from the room and prevents the user from joining it again,
+//returns id of the banned user
+func (r *RoomService) Ban(roomID string, by string, peerID string) (*Room, string, error) {
+	userID := ""
+	room, err := r.moderate(roomID, by, peerID, func(e *roomEntry, target User) {
+		userID = target.ID
+		e.removePeers(func(u User) bool { return u.ID == target.ID })
+		if !contains(e.room.Banned, target.ID) {
+			e.room.Banned = append(append([]string{}, e.room.Banned...), target.ID)
+		}
+	})
+	return room, userID, err
+}
+
+//Unban allows the user to join the room again
+func (r *RoomService) Unban(roomID string, by string, userID string) (*Room, error) {
+	return r.update(roomID, func(room *Room) error {
+		if !canModerate(room, by) {
+			return errForbidden
+		}
+		if !contains(room.Banned, userID) {
+			return errors.Wrapf(errNotMember, "banned user %s", userID)
+		}
+		banned := []string{}
+		for _, id := range room.Banned {
+			if id != userID {
+				banned = append(banned, id)
+			}
+		}
+		room.Banned = banned
+		return nil
+	})
+}
+
+//Mute mutes or unmutes media of the peer
+func (r *RoomService) Mute(roomID string, by string, peerID string, media []string, muted bool) (*Room, error) {
+	return r.moderate(roomID, by, peerID, func(e *roomEntry, target User) {
+		for i := range e.room.Users {
+			u := &e.room.Users[i]
+			if u.PeerID != peerID {
+				continue
+			}
+			list := []string{}
+			for _, m := range u.Muted {
+				if !contains(media, m) {
+					list = append(list, m)
+				}
+			}
+			if muted {
+				list = append(list, media...)
+			}
+			u.Muted = nil
+			if len(list) > 0 {
+				u.Muted = list
+			}
+		}
+	})
+}
+
+// moderate applies fn to the target peer of the room if by user is allowed to moderate it,
+// the target user has to have lower role than by user
+func (r *RoomService) moderate(roomID string, by string, peerID string, fn func(e *roomEntry, target User)) (*Room, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	if !canModerate(&e.room, by) {
+		log.Printf("%s is not allowed to moderate room %s", by, roomID)
+		return nil, errForbidden
+	}
+	for _, u := range e.room.Users {
+		if u.PeerID == "" || u.PeerID != peerID {
+			continue
+		}
+		if roleRanks[userRole(&e.room, u.ID)] >= roleRanks[userRole(&e.room, by)] {
+			log.Printf("%s is not allowed to moderate %s in room %s", by, peerID, roomID)
+			return nil, errForbidden
+		}
+		fn(e, u)
+		r.persist(e)
+		return e.snapshot(), nil
+	}
+	return nil, errors.Wrapf(errNotMember, "peer %s", peerID)
+}
+
+// removePeers removes matched users from the room, owner is never matched
+func (e *roomEntry) removePeers(match func(u User) bool) {
+	e.room.Users = filterUsers(e.room.Users, func(u User) bool {
+		return u.PeerID == e.room.Owner || !match(u)
+	})
+	if !hasUser(e.room.Users, e.room.Successor) {
+		e.room.Successor = ""
+	}
+}
+
+// canModerate checks that the user is owner or moderator of the room
+func canModerate(room *Room, userID string) bool {
+	return hasRole(userRole(room, userID), manageRole)
+}
+
+// isMuted checks that the media of the peer is muted
+func isMuted(room *Room, peerID string, media string) bool {
+	for _, u := range room.Users {
+		if u.PeerID == peerID && contains(u.Muted, media) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMutedAny checks that any of the media is muted for the peer
+func isMutedAny(room *Room, peerID string, media []string) bool {
+	for _, m := range media {
+		if isMuted(room, peerID, m) {
+			return true
+		}
+	}
+	return false
+}
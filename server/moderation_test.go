@@ -0,0 +1,91 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func moderatedRoomT(t *testing.T) (*RoomService, *Room) {
+	rooms := NewRoomService()
+	room, err := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{Private: true}, "")
+	require.NoError(t, err)
+	moderator, _ := rooms.CreateInvite(room.ID, "owner", 0, roleModerator)
+	participant, _ := rooms.CreateInvite(room.ID, "owner", 0, "participant")
+	rooms.JoinWithInvite(room.ID, User{ID: "mod", PeerID: "mod-peer"}, moderator)
+	rooms.JoinWithInvite(room.ID, User{ID: "a", PeerID: "a-peer"}, participant)
+	rooms.JoinWithInvite(room.ID, User{ID: "a", PeerID: "a-peer2"}, participant)
+	room, _ = rooms.JoinWithInvite(room.ID, User{ID: "b", PeerID: "b-peer"}, participant)
+	return rooms, room
+}
+
+func TestKick(t *testing.T) {
+	rooms, room := moderatedRoomT(t)
+
+	_, err := rooms.Kick(room.ID, "a", "b-peer")
+	require.Equal(t, errForbidden, err)
+	_, err = rooms.Kick(room.ID, "mod", "owner-peer")
+	require.Equal(t, errForbidden, err)
+	_, err = rooms.Kick(room.ID, "mod", "none")
+	require.Equal(t, errNotMember, errors.Cause(err))
+
+	updated, err := rooms.Kick(room.ID, "mod", "a-peer")
+	require.NoError(t, err)
+	assert.Len(t, updated.Users, 4)
+	assert.False(t, hasUser(updated.Users, "a-peer"))
+	assert.True(t, hasUser(updated.Users, "a-peer2"))
+
+	// moderator is kicked by owner only
+	_, err = rooms.Kick(room.ID, "mod", "mod-peer")
+	require.Equal(t, errForbidden, err)
+	updated, err = rooms.Kick(room.ID, "owner", "mod-peer")
+	require.NoError(t, err)
+	assert.False(t, hasUser(updated.Users, "mod-peer"))
+	_, err = rooms.Kick(room.ID, "mod", "b-peer")
+	require.Equal(t, errForbidden, err)
+}
+
+func TestBan(t *testing.T) {
+	rooms, room := moderatedRoomT(t)
+
+	updated, banned, err := rooms.Ban(room.ID, "mod", "a-peer")
+	require.NoError(t, err)
+	assert.Equal(t, "a", banned)
+	assert.Equal(t, []string{"a"}, updated.Banned)
+	assert.False(t, hasUser(updated.Users, "a-peer"))
+	assert.False(t, hasUser(updated.Users, "a-peer2"))
+
+	invite, _ := rooms.CreateInvite(room.ID, "owner", 0, "")
+	_, err = rooms.JoinWithInvite(room.ID, User{ID: "a", PeerID: "a-peer3"}, invite)
+	require.Equal(t, errBanned, err)
+
+	_, err = rooms.Unban(room.ID, "b", "a")
+	require.Equal(t, errForbidden, err)
+	_, err = rooms.Unban(room.ID, "mod", "b")
+	require.Equal(t, errNotMember, errors.Cause(err))
+	updated, err = rooms.Unban(room.ID, "mod", "a")
+	require.NoError(t, err)
+	assert.Empty(t, updated.Banned)
+	_, err = rooms.JoinWithInvite(room.ID, User{ID: "a", PeerID: "a-peer3"}, invite)
+	require.NoError(t, err)
+}
+
+func TestMute(t *testing.T) {
+	rooms, room := moderatedRoomT(t)
+
+	updated, err := rooms.Mute(room.ID, "mod", "b-peer", []string{mediaAudio, mediaChat}, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{mediaAudio, mediaChat}, updated.Users[4].Muted)
+	_, err = rooms.AddMessage(room.ID, RoomMessage{Author: "b-peer", Text: "hi"})
+	require.Equal(t, errMuted, err)
+	_, err = rooms.AddMessage(room.ID, RoomMessage{Author: "a-peer", Text: "hi"})
+	require.NoError(t, err)
+
+	updated, err = rooms.Mute(room.ID, "owner", "b-peer", []string{mediaChat}, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{mediaAudio}, updated.Users[4].Muted)
+	_, err = rooms.AddMessage(room.ID, RoomMessage{Author: "b-peer", Text: "hi"})
+	require.NoError(t, err)
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// protocol versions, connection without hello uses legacy version
+const (
+	ProtocolVersion       = 2
+	MinProtocolVersion    = 1
+	legacyProtocolVersion = 1
+)
+
+// message directions
+const (
+	fromClient = "client"
+	fromServer = "server"
+	bothWays   = "both"
+)
+
+// capabilities supported by server, negotiated in hello
+var serverCapabilities = []string{"ack", "error", "resume", "peerState", "topology", "ownership", "moderation", "roles", "lobby", "chatEdit", "threads", "events", capRoomEvents}
+
+// capRoomEvents is capability to get room changes instead of room snapshots
+const capRoomEvents = "roomEvents"
+
+// messageSpec describes message type, request is data sent by client, event is data sent by server
+type messageSpec struct {
+	Type      int
+	Name      string
+	Direction string
+	Since     int // protocol version
+	Request   interface{}
+	Event     interface{}
+}
+
+var messageSpecs = []messageSpec{
+	{textMessage, "text", bothWays, 1, TextPayload{}, RoomMessage{}},
+	{createRoomMessage, "createRoom", fromClient, 1, CreateRoomPayload{}, nil},
+	{joinRoomMessage, "joinRoom", fromClient, 1, JoinRoomPayload{}, nil},
+	{leaveRoomMessage, "leaveRoom", fromClient, 1, LeaveRoomPayload{}, nil},
+	{sdpMessage, "sdp", bothWays, 1, SDPPayload{}, SDPPayload{}},
+	{candidateMessage, "candidate", bothWays, 1, CandidatePayload{}, CandidatePayload{}},
+	{roomIsCreatedMessage, "roomIsCreated", fromServer, 1, nil, RoomSnapshot{}},
+	{roomUpdateMessage, "roomUpdate", fromServer, 1, nil, RoomSnapshot{}},
+	{startPeerConnectionMessage, "startPeerConnection", fromServer, 1, nil, PeerPayload{}},
+	{stopPeerConnectionMessage, "stopPeerConnection", fromServer, 2, nil, PeerPayload{}},
+	{transferOwnershipMessage, "transferOwnership", fromClient, 2, TransferOwnershipPayload{}, nil},
+	{kickMessage, "kick", fromClient, 2, ModeratePayload{}, nil},
+	{banMessage, "ban", fromClient, 2, ModeratePayload{}, nil},
+	{muteMessage, "mute", fromClient, 2, MutePayload{}, nil},
+	{moderationMessage, "moderation", fromServer, 2, nil, ModerationPayload{}},
+	{setRoleMessage, "setRole", fromClient, 2, SetRolePayload{}, nil},
+	{lobbyMessage, "lobby", fromServer, 2, nil, LobbyPayload{}},
+	{admitMessage, "admit", fromClient, 2, ModeratePayload{}, nil},
+	{denyMessage, "deny", fromClient, 2, ModeratePayload{}, nil},
+	{editMessage, "editMessage", bothWays, 2, EditMessagePayload{}, RoomMessage{}},
+	{deleteMessage, "deleteMessage", bothWays, 2, DeleteMessagePayload{}, DeleteMessagePayload{}},
+	{reactionMessage, "reaction", bothWays, 2, ReactionPayload{}, ReactionEventPayload{}},
+	{eventMessage, "event", bothWays, 2, EventPayload{}, RoomEventPayload{}},
+	{roomClosedMessage, "roomClosed", fromServer, 2, nil, RoomClosedPayload{}},
+	{roomChangeMessage, "roomChange", fromServer, 2, nil, RoomChange{}},
+	{syncRoomMessage, "syncRoom", fromClient, 2, SyncRoomPayload{}, nil},
+	{roomClosingMessage, "roomClosing", fromServer, 2, nil, RoomClosingPayload{}},
+	{addFakeUser, "addFakeUser", fromClient, 1, FakeUserPayload{}, nil},
+	{removeFakeUser, "removeFakeUser", fromClient, 1, FakeUserPayload{}, nil},
+	{sessionMessage, "session", fromServer, 1, nil, SessionPayload{}},
+	{peerStateMessage, "peerState", fromServer, 1, nil, PeerStatePayload{}},
+	{errorMessage, "error", fromServer, 1, nil, ErrorPayload{}},
+	{ackMessage, "ack", fromServer, 1, nil, AckPayload{}},
+	{helloMessage, "hello", bothWays, 2, HelloPayload{}, HelloPayload{}},
+}
+
+// lowest roles allowed to send messages to the room, they are checked by WsServer.authorize,
+// messages which are not listed are allowed to everyone
+var messageRoles = map[int]string{
+	textMessage:              chatRole,
+	editMessage:              chatRole,
+	reactionMessage:          chatRole,
+	sdpMessage:               publishRole, // to send media, viewers may answer with receive only description
+	addFakeUser:              manageRole,
+	removeFakeUser:           manageRole,
+	kickMessage:              manageRole,
+	banMessage:               manageRole,
+	muteMessage:              manageRole,
+	setRoleMessage:           manageRole,
+	admitMessage:             manageRole,
+	denyMessage:              manageRole,
+	transferOwnershipMessage: roleOwner,
+}
+
+// negotiate returns common protocol version and capabilities
+func negotiate(hello HelloPayload) (HelloPayload, error) {
+	if hello.Version < MinProtocolVersion {
+		return HelloPayload{}, newProtocolError(codeUnsupportedVersion, "version %d is not supported, min version is %d", hello.Version, MinProtocolVersion)
+	}
+	res := HelloPayload{Version: hello.Version, Capabilities: []string{}}
+	if res.Version > ProtocolVersion {
+		res.Version = ProtocolVersion
+	}
+	for _, c := range hello.Capabilities {
+		for _, sc := range serverCapabilities {
+			if c == sc {
+				res.Capabilities = append(res.Capabilities, c)
+			}
+		}
+	}
+	return res, nil
+}
+
+// decodePayload parses message data into payload struct and validates it,
+// strict decoding rejects unknown fields, empty or null data decodes to zero payload
+func decodePayload(data json.RawMessage, payload interface{}, strict bool) error {
+	if len(data) != 0 && string(data) != "null" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		if strict {
+			decoder.DisallowUnknownFields()
+		}
+		if err := decoder.Decode(payload); err != nil {
+			return newProtocolError(codeBadMessage, "invalid message data: %v", err)
+		}
+	}
+	return validatePayload(payload)
+}
+
+// validatePayload checks `validate` tags of the struct fields, nested structs are checked as well:
+// required, max length of strings and lists, min value of numbers, oneof list of allowed values of not empty string
+// or of every string in the list
+func validatePayload(payload interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(payload))
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		name := jsonName(field)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		if value.Kind() == reflect.Struct {
+			if err := validatePayload(value.Addr().Interface()); err != nil {
+				return err
+			}
+		}
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			switch {
+			case rule == "required" && isBlank(value):
+				return newProtocolError(codeBadMessage, "%s is required", name)
+			case strings.HasPrefix(rule, "max="):
+				max, _ := strconv.Atoi(strings.TrimPrefix(rule, "max="))
+				if hasLength(value) && value.Len() > max {
+					return newProtocolError(codeBadMessage, "%s is longer than %d", name, max)
+				}
+			case strings.HasPrefix(rule, "min="):
+				min, _ := strconv.Atoi(strings.TrimPrefix(rule, "min="))
+				if isNumber(value) && value.Int() < int64(min) {
+					return newProtocolError(codeBadMessage, "%s is less than %d", name, min)
+				}
+			case strings.HasPrefix(rule, "oneof="):
+				allowed := strings.Fields(strings.TrimPrefix(rule, "oneof="))
+				if value.Kind() == reflect.String && value.Len() > 0 && !contains(allowed, value.String()) {
+					return newProtocolError(codeBadMessage, "%s has to be one of %v", name, allowed)
+				}
+				if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String {
+					for j := 0; j < value.Len(); j++ {
+						if !contains(allowed, value.Index(j).String()) {
+							return newProtocolError(codeBadMessage, "%s has to contain %v only", name, allowed)
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isBlank(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func hasLength(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return true
+	}
+	return false
+}
+
+func isNumber(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// ProtocolDescription returns machine readable description of the protocol,
+// payloads are described with JSON schema, so clients can generate code from it
+func ProtocolDescription() map[string]interface{} {
+	messages := []map[string]interface{}{}
+	for _, spec := range messageSpecs {
+		m := map[string]interface{}{
+			"type":      spec.Type,
+			"name":      spec.Name,
+			"direction": spec.Direction,
+			"since":     spec.Since,
+		}
+		if role, ok := messageRoles[spec.Type]; ok {
+			m["role"] = role
+		}
+		if spec.Request != nil {
+			m["request"] = schemaOf(reflect.TypeOf(spec.Request))
+		}
+		if spec.Event != nil {
+			m["event"] = schemaOf(reflect.TypeOf(spec.Event))
+		}
+		messages = append(messages, m)
+	}
+	errorCodes := []string{codeBadMessage, codeTooLarge, codeUnknownType, codeUnsupportedVersion, codeRoomNotFound,
+		codeNotOwner, codeNotMember, codePeerNotFound, codeInviteRequired, codeInvalidInvite, codeWrongPassword, codeRoomFull,
+		codeForbidden, codeBanned, codeMuted, codeMessageNotFound, codeRateLimited, codeInternal}
+	return map[string]interface{}{
+		"version":      ProtocolVersion,
+		"minVersion":   MinProtocolVersion,
+		"capabilities": serverCapabilities,
+		"envelope":     schemaOf(reflect.TypeOf(Message{})),
+		"messages":     messages,
+		"errorCodes":   errorCodes,
+		"roles":        []string{roleOwner, roleModerator, roleParticipant, roleViewer},
+	}
+}
+
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]interface{}{}
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+				continue // unexported
+			}
+			name := jsonName(field)
+			schema := schemaOf(field.Type)
+			for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+				if rule == "required" {
+					required = append(required, name)
+				}
+				if strings.HasPrefix(rule, "oneof=") {
+					enum := strings.Fields(strings.TrimPrefix(rule, "oneof="))
+					if field.Type.Kind() == reflect.Slice {
+						schema["items"].(map[string]interface{})["enum"] = enum
+					} else {
+						schema["enum"] = enum
+					}
+				}
+				if strings.HasPrefix(rule, "min=") {
+					schema["minimum"], _ = strconv.Atoi(strings.TrimPrefix(rule, "min="))
+				}
+				if strings.HasPrefix(rule, "max=") {
+					max, _ := strconv.Atoi(strings.TrimPrefix(rule, "max="))
+					if field.Type.Kind() == reflect.String {
+						schema["maxLength"] = max
+					} else {
+						schema["maxItems"] = max
+					}
+				}
+			}
+			properties[name] = schema
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+// ProtocolHandler renders protocol description
+func (s *WsServer) ProtocolHandler(w http.ResponseWriter, r *http.Request) {
+	description := ProtocolDescription()
+	description["maxMessageSize"] = s.MaxMessageSize
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, description)
+}
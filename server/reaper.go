@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// reasons of closing room
+const (
+	closedIdle    = "idle"    // room has no activity and no connected peers during idle ttl
+	closedExpired = "expired" // room is older than max lifetime
+	closedDeleted = "deleted" // room is deleted by owner
+)
+
+const (
+	defaultIdleTTL      = time.Hour
+	defaultCloseWarning = 5 * time.Minute
+	defaultReapInterval = time.Minute
+)
+
+// ClosedRoom is room removed or going to be removed by reaper
+type ClosedRoom struct {
+	Room     Room
+	Reason   string
+	Deadline time.Time // when the closing room is removed, zero for removed room
+}
+
+//Expire removes rooms which are idle longer than IdleTTL and have no online peer, or are older than MaxLifetime,
+//rooms reaching MaxLifetime are returned as closing CloseWarning before they are removed, idle rooms are removed
+//without warning since nobody is online there, online reports that the peer is connected, it is called without room locks
+func (r *RoomService) Expire(now time.Time, online func(peerID string) bool) (closing []ClosedRoom, closed []ClosedRoom) {
+	closing, closed = []ClosedRoom{}, []ClosedRoom{}
+	for _, e := range r.entries() {
+		e.Lock()
+		room, active, deadline := e.snapshot(), e.active, e.closing
+		e.Unlock()
+		reason := ""
+		if r.MaxLifetime > 0 && !now.Before(room.Created.Add(r.MaxLifetime-r.CloseWarning)) {
+			reason = closedExpired
+		} else if r.IdleTTL > 0 && now.Sub(active) > r.IdleTTL && !hasOnline(room, online) {
+			reason = closedIdle
+		}
+		if reason == "" {
+			continue
+		}
+		if reason == closedExpired && r.CloseWarning > 0 && (deadline.IsZero() || now.Before(deadline)) {
+			if deadline.IsZero() {
+				closing = append(closing, r.warn(e, now)...)
+			}
+			continue
+		}
+		e.Lock()
+		// the room may be changed or removed meanwhile
+		if !e.closed && (reason == closedExpired || e.active.Equal(active)) {
+			log.Printf("[INFO] room %s is closed, %s", room.ID, reason)
+			closed = append(closed, ClosedRoom{Room: *e.snapshot(), Reason: reason})
+			r.remove(e)
+		}
+		e.Unlock()
+	}
+	return closing, closed
+}
+
+// warn sets closing deadline of the room, peers get full CloseWarning even if the reaper is late
+func (r *RoomService) warn(e *roomEntry, now time.Time) []ClosedRoom {
+	e.Lock()
+	defer e.Unlock()
+	if e.closed || !e.closing.IsZero() {
+		return nil
+	}
+	e.closing = e.room.Created.Add(r.MaxLifetime)
+	if e.closing.Before(now.Add(r.CloseWarning)) {
+		e.closing = now.Add(r.CloseWarning)
+	}
+	log.Printf("[INFO] room %s is closing at %s", e.room.ID, e.closing)
+	return []ClosedRoom{{Room: *e.snapshot(), Reason: closedExpired, Deadline: e.closing}}
+}
+
+//Reap closes expired rooms every interval till the context is done, remaining peers of the room are notified
+func (s *WsServer) Reap(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.reap(now)
+		}
+	}
+}
+
+func (s *WsServer) reap(now time.Time) {
+	closing, closed := s.rooms.Expire(now, s.isOnline)
+	for _, c := range closing {
+		data := composeData(RoomClosingPayload{RoomID: c.Room.ID, Reason: c.Reason, Deadline: c.Deadline.UTC().Format(time.RFC3339)})
+		s.sendToAllRoom(&c.Room, &Message{From: c.Room.ID, Type: roomClosingMessage, Data: data, To: "all"})
+	}
+	for _, c := range closed {
+		s.notifyClosed(&c.Room, c.Reason)
+	}
+}
+
+// notifyClosed tells the peers of removed room why it is closed
+func (s *WsServer) notifyClosed(room *Room, reason string) {
+	data := composeData(RoomClosedPayload{RoomID: room.ID, Reason: reason})
+	s.sendToAllRoom(room, &Message{From: room.ID, Type: roomClosedMessage, Data: data, To: "all"})
+}
+
+// isOnline checks that the peer is connected or reconnecting
+func (s *WsServer) isOnline(peerID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sessions[peerID] != nil
+}
+
+// hasOnline checks that any real peer of the room is online
+func hasOnline(room *Room, online func(peerID string) bool) bool {
+	for _, u := range room.Users {
+		if u.PeerID != "" && online(u.PeerID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpireRooms(t *testing.T) {
+	rooms := NewRoomService()
+	rooms.IdleTTL = time.Hour
+	rooms.MaxLifetime = 24 * time.Hour
+	rooms.CloseWarning = time.Hour
+	idle, _ := rooms.CreateRoom(User{ID: "a", PeerID: "a-peer"}, RoomSettings{}, "")
+	rooms.AddFakeUser(idle.ID, "a", &User{ID: "fake", Name: "fake"})
+	online, _ := rooms.CreateRoom(User{ID: "b", PeerID: "b-peer"}, RoomSettings{}, "")
+	isOnline := func(peerID string) bool { return peerID == "b-peer" }
+	now := time.Now()
+
+	closing, closed := rooms.Expire(now, isOnline)
+	assert.Empty(t, closing)
+	assert.Empty(t, closed)
+	// idle room is closed without warning
+	closing, closed = rooms.Expire(now.Add(2*time.Hour), isOnline)
+	assert.Empty(t, closing)
+	require.Len(t, closed, 1)
+	assert.Equal(t, idle.ID, closed[0].Room.ID)
+	assert.Equal(t, closedIdle, closed[0].Reason)
+	assert.Len(t, closed[0].Room.Users, 2)
+	assert.Nil(t, rooms.GetRoom(idle.ID))
+
+	// active room is closed after max lifetime, peers are warned before
+	closing, closed = rooms.Expire(online.Created.Add(23*time.Hour), isOnline)
+	assert.Empty(t, closed)
+	require.Len(t, closing, 1)
+	assert.Equal(t, online.ID, closing[0].Room.ID)
+	assert.Equal(t, closedExpired, closing[0].Reason)
+	assert.Equal(t, online.Created.Add(24*time.Hour), closing[0].Deadline)
+	closing, closed = rooms.Expire(now.Add(23*time.Hour+45*time.Minute), isOnline)
+	assert.Empty(t, closing)
+	assert.Empty(t, closed)
+	closing, closed = rooms.Expire(now.Add(25*time.Hour), isOnline)
+	assert.Empty(t, closing)
+	require.Len(t, closed, 1)
+	assert.Equal(t, online.ID, closed[0].Room.ID)
+	assert.Equal(t, closedExpired, closed[0].Reason)
+
+	// late reaper gives full warning
+	late, _ := rooms.CreateRoom(User{ID: "b", PeerID: "b-peer"}, RoomSettings{}, "")
+	closing, _ = rooms.Expire(now.Add(30*time.Hour), isOnline)
+	require.Len(t, closing, 1)
+	assert.Equal(t, now.Add(31*time.Hour), closing[0].Deadline)
+	_, closed = rooms.Expire(now.Add(30*time.Hour+30*time.Minute), isOnline)
+	assert.Empty(t, closed)
+	_, closed = rooms.Expire(now.Add(31*time.Hour), isOnline)
+	require.Len(t, closed, 1)
+	assert.Equal(t, late.ID, closed[0].Room.ID)
+
+	rooms.IdleTTL = 0
+	rooms.MaxLifetime = 0
+	rooms.CreateRoom(User{ID: "c", PeerID: "c-peer"}, RoomSettings{}, "")
+	closing, closed = rooms.Expire(now.Add(1000*time.Hour), isOnline)
+	assert.Empty(t, closing)
+	assert.Empty(t, closed)
+}
+
+func TestReaper(t *testing.T) {
+	s, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	rooms.MaxLifetime = 200 * time.Millisecond
+	rooms.CloseWarning = 100 * time.Millisecond
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wsServer.Reap(ctx, 50*time.Millisecond)
+
+	msg := nextTypeWsT(t, owner, roomClosingMessage)
+	warning := RoomClosingPayload{}
+	require.Nil(t, json.Unmarshal(msg.Data, &warning))
+	assert.Equal(t, roomID, warning.RoomID)
+	assert.Equal(t, closedExpired, warning.Reason)
+	deadline, err := time.Parse(time.RFC3339, warning.Deadline)
+	require.Nil(t, err)
+	assert.True(t, deadline.After(time.Now().Add(-time.Second)))
+	assert.NotNil(t, rooms.GetRoom(roomID))
+
+	msg = nextTypeWsT(t, owner, roomClosedMessage)
+	closed := RoomClosedPayload{}
+	require.Nil(t, json.Unmarshal(msg.Data, &closed))
+	assert.Equal(t, RoomClosedPayload{RoomID: roomID, Reason: closedExpired}, closed)
+	assert.Nil(t, rooms.GetRoom(roomID))
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"log"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// roles of room members, every role has rights of the lower ones
+const (
+	roleOwner       = "owner"       // room creator, there is the only owner
+	roleModerator   = "moderator"   // manages participants and fake users
+	roleParticipant = "participant" // publishes media and chats
+	roleViewer      = "viewer"      // receives media and reads chat only
+)
+
+var roleRanks = map[string]int{roleViewer: 1, roleParticipant: 2, roleModerator: 3, roleOwner: 4}
+
+// lowest roles allowed to perform room actions
+const (
+	chatRole    = roleParticipant
+	publishRole = roleParticipant
+	manageRole  = roleModerator // fake users, moderation and roles of other members
+)
+
+//SetRole changes role of the peer, by user has to have higher role than both old and new role of the peer,
+//owner role is changed by ownership transfer only
+func (r *RoomService) SetRole(roomID string, by string, peerID string, role string) (*Room, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	rank := roleRanks[userRole(&e.room, by)]
+	if rank < roleRanks[manageRole] || rank <= roleRanks[role] || role == roleOwner {
+		log.Printf("%s is not allowed to set role %s in room %s", by, role, roomID)
+		return nil, errForbidden
+	}
+	for i := range e.room.Users {
+		u := &e.room.Users[i]
+		if u.PeerID == "" || u.PeerID != peerID {
+			continue
+		}
+		if rank <= roleRanks[userRole(&e.room, u.ID)] {
+			return nil, errForbidden
+		}
+		u.Role = role
+		r.persist(e)
+		return e.snapshot(), nil
+	}
+	return nil, errors.Wrapf(errNotMember, "peer %s", peerID)
+}
+
+//UserRole returns the highest role of the user peers in the room, empty if the user is not in the room
+func (r *RoomService) UserRole(roomID string, userID string) (string, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return "", err
+	}
+	defer e.Unlock()
+	return userRole(&e.room, userID), nil
+}
+
+//CanPublish checks that the peer may send the media to the other peer, it may if they share a room
+//where the peer is allowed to publish and none of the media is muted by moderator
+func (r *RoomService) CanPublish(peerID string, to string, media []string) bool {
+	for _, e := range r.entries() {
+		e.Lock()
+		if !e.closed && hasUser(e.room.Users, peerID) && hasUser(e.room.Users, to) &&
+			hasRole(peerRole(&e.room, peerID), publishRole) && !isMutedAny(&e.room, peerID, media) {
+			e.Unlock()
+			return true
+		}
+		e.Unlock()
+	}
+	return false
+}
+
+// setOwner hands the room over to the peer, the previous owner becomes moderator
+func (e *roomEntry) setOwner(peerID string) {
+	for i := range e.room.Users {
+		u := &e.room.Users[i]
+		if u.PeerID == e.room.Owner && u.Role == roleOwner {
+			u.Role = roleModerator
+		}
+		if u.PeerID == peerID {
+			u.Role = roleOwner
+			e.ownerID = u.ID
+		}
+	}
+	e.room.Owner = peerID
+}
+
+// hasRole checks that the role has rights of the required role
+func hasRole(role string, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// peerRole returns role of the room peer, empty if the peer is not in the room
+func peerRole(room *Room, peerID string) string {
+	for _, u := range room.Users {
+		if u.PeerID != "" && u.PeerID == peerID {
+			return u.Role
+		}
+	}
+	return ""
+}
+
+// userRole returns the highest role of the user peers in the room
+func userRole(room *Room, userID string) string {
+	role := ""
+	for _, u := range room.Users {
+		if u.PeerID != "" && u.ID == userID && roleRanks[u.Role] > roleRanks[role] {
+			role = u.Role
+		}
+	}
+	return role
+}
+
+// sdpSendsMedia returns kinds of media, audio or video, the session description offers to send,
+// media direction is set per media section or for the whole session, sendrecv is default
+func sdpSendsMedia(sdp string) []string {
+	session, media, kind := "", "", ""
+	sent := []string{}
+	sends := func() {
+		direction := media
+		if direction == "" {
+			direction = session
+		}
+		if (kind == mediaAudio || kind == mediaVideo) && direction != "recvonly" && direction != "inactive" && !contains(sent, kind) {
+			sent = append(sent, kind)
+		}
+	}
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			sends()
+			kind, media = strings.SplitN(strings.TrimPrefix(line, "m=")+" ", " ", 2)[0], ""
+		case line == "a=sendrecv" || line == "a=sendonly" || line == "a=recvonly" || line == "a=inactive":
+			if kind == "" {
+				session = strings.TrimPrefix(line, "a=")
+			} else {
+				media = strings.TrimPrefix(line, "a=")
+			}
+		}
+	}
+	sends()
+	return sent
+}
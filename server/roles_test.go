@@ -0,0 +1,99 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoles(t *testing.T) {
+	rooms, room := moderatedRoomT(t)
+	roles := map[string]string{}
+	for _, u := range room.Users {
+		roles[u.PeerID] = u.Role
+	}
+	assert.Equal(t, map[string]string{"owner-peer": roleOwner, "mod-peer": roleModerator, "a-peer": roleParticipant, "a-peer2": roleParticipant, "b-peer": roleParticipant}, roles)
+	assert.Contains(t, string(RoomToMap(room)), `"role":"moderator"`)
+
+	updated, err := rooms.SetRole(room.ID, "mod", "b-peer", roleViewer)
+	require.NoError(t, err)
+	assert.Equal(t, roleViewer, peerRole(updated, "b-peer"))
+	_, err = rooms.AddMessage(room.ID, RoomMessage{Author: "b-peer", Text: "hi"})
+	require.Equal(t, errForbidden, err)
+
+	// moderator cannot grant its own role or change equal one
+	_, err = rooms.SetRole(room.ID, "mod", "b-peer", roleModerator)
+	require.Equal(t, errForbidden, err)
+	_, err = rooms.SetRole(room.ID, "a", "b-peer", roleParticipant)
+	require.Equal(t, errForbidden, err)
+	_, err = rooms.SetRole(room.ID, "owner", "owner-peer", roleViewer)
+	require.Equal(t, errForbidden, err)
+	_, err = rooms.SetRole(room.ID, "owner", "none", roleViewer)
+	require.Equal(t, errNotMember, errors.Cause(err))
+	updated, err = rooms.SetRole(room.ID, "owner", "a-peer", roleModerator)
+	require.NoError(t, err)
+	assert.Equal(t, roleModerator, peerRole(updated, "a-peer"))
+	_, err = rooms.SetRole(room.ID, "mod", "a-peer2", roleViewer)
+	require.Equal(t, errForbidden, err)
+
+	// fake users are managed by moderators only
+	_, err = rooms.AddFakeUser(room.ID, "b", &User{ID: "fake"})
+	require.Equal(t, errForbidden, err)
+	_, err = rooms.AddFakeUser(room.ID, "mod", &User{ID: "fake"})
+	require.NoError(t, err)
+	_, err = rooms.RemoveFakeUser(room.ID, "b", "fake")
+	require.Equal(t, errForbidden, err)
+
+	// previous owner becomes moderator
+	updated, err = rooms.TransferOwnership(room.ID, "owner-peer", "mod-peer")
+	require.NoError(t, err)
+	assert.Equal(t, roleOwner, peerRole(updated, "mod-peer"))
+	assert.Equal(t, roleModerator, peerRole(updated, "owner-peer"))
+	updated, err = rooms.LeaveRoom(room.ID, "mod-peer")
+	require.NoError(t, err)
+	assert.Equal(t, "owner-peer", updated.Owner)
+	assert.Equal(t, roleOwner, peerRole(updated, "owner-peer"))
+}
+
+func TestCanPublish(t *testing.T) {
+	rooms, room := moderatedRoomT(t)
+	_, err := rooms.SetRole(room.ID, "owner", "b-peer", roleViewer)
+	require.NoError(t, err)
+	assert.True(t, rooms.CanPublish("a-peer", "b-peer", []string{mediaAudio}))
+	assert.False(t, rooms.CanPublish("b-peer", "a-peer", []string{mediaAudio}))
+	// peers of no shared room, i.e. kicked ones, cannot publish
+	assert.False(t, rooms.CanPublish("a-peer", "unknown", []string{mediaAudio}))
+	// force-muted media cannot be published
+	_, err = rooms.Mute(room.ID, "owner", "a-peer", []string{mediaAudio, mediaVideo}, true)
+	require.NoError(t, err)
+	assert.False(t, rooms.CanPublish("a-peer", "b-peer", []string{mediaAudio}))
+	assert.False(t, rooms.CanPublish("a-peer", "b-peer", []string{mediaVideo, mediaAudio}))
+	_, err = rooms.Mute(room.ID, "owner", "a-peer", []string{mediaVideo}, false)
+	require.NoError(t, err)
+	assert.True(t, rooms.CanPublish("a-peer", "b-peer", []string{mediaVideo}))
+
+	// viewer may publish to peers of the room where it is participant
+	other, _ := rooms.CreateRoom(User{ID: "b", PeerID: "b-peer"}, RoomSettings{}, "")
+	rooms.JoinToRoom(other.ID, User{ID: "a", PeerID: "a-peer"}, "")
+	assert.True(t, rooms.CanPublish("b-peer", "a-peer", []string{mediaVideo}))
+}
+
+func TestSDPSendsMedia(t *testing.T) {
+	tests := []struct {
+		sdp   string
+		sends []string
+	}{
+		{"v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\n", []string{mediaAudio}},
+		{"v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=recvonly\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=inactive\r\n", []string{}},
+		{"v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=recvonly\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=sendonly\r\n", []string{mediaVideo}},
+		{"v=0\r\na=recvonly\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\n", []string{}},
+		{"v=0\r\na=recvonly\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=sendrecv\r\n", []string{mediaVideo}},
+		{"v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\n", []string{mediaAudio, mediaVideo}},
+		{"v=0\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n", []string{}},
+	}
+	for i, test := range tests {
+		assert.Equal(t, test.sends, sdpSendsMedia(test.sdp), "sdp %d", i)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"reflect"
+)
+
+// kinds of room changes
+const (
+	changeJoined   = "joined"   // user is added to the room
+	changeLeft     = "left"     // user is removed from the room
+	changeUpdated  = "updated"  // user role, state or mute is changed
+	changeOwner    = "owner"    // owner or successor is changed
+	changeSettings = "settings" // room settings are changed
+	changeBanned   = "banned"   // list of banned users is changed
+	changePending  = "pending"  // lobby is changed
+)
+
+// RoomChange is incremental change of the room, every change increments room version,
+// peers which support room events get changes instead of full room snapshots
+type RoomChange struct {
+	RoomID    string        `json:"roomId"`
+	Version   int64         `json:"version"` // room version after the change
+	Kind      string        `json:"kind"`
+	User      *User         `json:"user,omitempty"`      // joined and updated
+	PeerID    string        `json:"peerId,omitempty"`    // left, empty for fake user
+	UserID    string        `json:"userId,omitempty"`    // left
+	Owner     string        `json:"owner,omitempty"`     // owner, empty owner or successor means there is no one
+	Successor string        `json:"successor,omitempty"` // owner
+	Settings  *RoomSettings `json:"settings,omitempty"`  // settings
+	Banned    []string      `json:"banned,omitempty"`    // banned, the whole list
+	Pending   []User        `json:"pending,omitempty"`   // pending, the whole list
+}
+
+// roomState is part of the room published with changes, chat messages have their own events
+type roomState struct {
+	users     []User
+	owner     string
+	successor string
+	settings  RoomSettings
+	banned    []string
+	pending   []User
+}
+
+func stateOf(room *Room) roomState {
+	return roomState{
+		users:     append([]User{}, room.Users...),
+		owner:     room.Owner,
+		successor: room.Successor,
+		settings:  room.Settings,
+		banned:    append([]string{}, room.Banned...),
+		pending:   append([]User{}, room.Pending...),
+	}
+}
+
+// publish returns changes of locked room since the last published state and increments room version
+func (e *roomEntry) publish() []RoomChange {
+	state := stateOf(&e.room)
+	changes := diffRoom(e.published, state)
+	for i := range changes {
+		e.room.Version++
+		changes[i].RoomID = e.room.ID
+		changes[i].Version = e.room.Version
+	}
+	e.published = state
+	return changes
+}
+
+// diffRoom returns changes which turn old state into new one
+func diffRoom(old roomState, new roomState) []RoomChange {
+	changes := []RoomChange{}
+	for _, u := range old.users {
+		if _, ok := findUser(new.users, u); !ok {
+			changes = append(changes, RoomChange{Kind: changeLeft, PeerID: u.PeerID, UserID: u.ID})
+		}
+	}
+	for i := range new.users {
+		u := new.users[i]
+		prev, ok := findUser(old.users, u)
+		switch {
+		case !ok:
+			changes = append(changes, RoomChange{Kind: changeJoined, User: &u})
+		case !reflect.DeepEqual(prev, u):
+			changes = append(changes, RoomChange{Kind: changeUpdated, User: &u})
+		}
+	}
+	if old.owner != new.owner || old.successor != new.successor {
+		changes = append(changes, RoomChange{Kind: changeOwner, Owner: new.owner, Successor: new.successor})
+	}
+	if old.settings != new.settings {
+		settings := new.settings
+		changes = append(changes, RoomChange{Kind: changeSettings, Settings: &settings})
+	}
+	if !reflect.DeepEqual(old.banned, new.banned) {
+		changes = append(changes, RoomChange{Kind: changeBanned, Banned: new.banned})
+	}
+	if !reflect.DeepEqual(old.pending, new.pending) {
+		changes = append(changes, RoomChange{Kind: changePending, Pending: new.pending})
+	}
+	return changes
+}
+
+// findUser finds the user in the list by peer id, fake users are found by user id
+func findUser(users []User, user User) (User, bool) {
+	for _, u := range users {
+		if u.PeerID == user.PeerID && (u.PeerID != "" || u.ID == user.ID) {
+			return u, true
+		}
+	}
+	return User{}, false
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffRoom(t *testing.T) {
+	old := roomState{users: []User{{ID: "a", PeerID: "a-peer"}, {ID: "fake"}}, owner: "a-peer"}
+	new := roomState{users: []User{{ID: "a", PeerID: "a-peer", Role: roleModerator}, {ID: "b", PeerID: "b-peer"}},
+		owner: "b-peer", settings: RoomSettings{Name: "room"}, banned: []string{"c"}}
+	changes := diffRoom(old, new)
+	kinds := []string{}
+	for _, c := range changes {
+		kinds = append(kinds, c.Kind)
+	}
+	assert.Equal(t, []string{changeLeft, changeUpdated, changeJoined, changeOwner, changeSettings, changeBanned}, kinds)
+	assert.Equal(t, "fake", changes[0].UserID)
+	assert.Equal(t, roleModerator, changes[1].User.Role)
+	assert.Equal(t, "b-peer", changes[2].User.PeerID)
+	assert.Empty(t, diffRoom(new, new))
+}
+
+func TestRoomVersion(t *testing.T) {
+	rooms := NewRoomService()
+	changes := []RoomChange{}
+	rooms.publisher = func(room *Room, published []RoomChange) {
+		assert.Equal(t, published[len(published)-1].Version, room.Version)
+		changes = published
+	}
+	published := func() []RoomChange {
+		res := changes
+		changes = []RoomChange{}
+		return res
+	}
+	room, _ := rooms.CreateRoom(User{ID: "a", PeerID: "a-peer"}, RoomSettings{}, "")
+	assert.Equal(t, int64(0), room.Version)
+	assert.Empty(t, published())
+
+	room, _ = rooms.JoinToRoom(room.ID, User{ID: "b", PeerID: "b-peer"}, "")
+	assert.Equal(t, int64(1), room.Version)
+	assert.Equal(t, []RoomChange{{RoomID: room.ID, Version: 1, Kind: changeJoined, User: &room.Users[1]}}, published())
+
+	updated := rooms.SetPeerState("b-peer", peerReconnecting)
+	require.Len(t, updated, 1)
+	assert.Equal(t, int64(2), updated[0].Version)
+	changed := published()
+	require.Len(t, changed, 1)
+	assert.Equal(t, changeUpdated, changed[0].Kind)
+	// readers do not publish changes
+	rooms.SetPeerState("b-peer", "")
+	published()
+	rooms.GetRoom(room.ID)
+	rooms.GetPeerRooms("b-peer")
+	rooms.GetUserRooms("b")
+	assert.Empty(t, published())
+	room, _ = rooms.Kick(room.ID, "a", "b-peer")
+	assert.Equal(t, []RoomChange{{RoomID: room.ID, Version: 4, Kind: changeLeft, PeerID: "b-peer", UserID: "b"}}, published())
+	room, _ = rooms.JoinToRoom(room.ID, User{ID: "b", PeerID: "b-peer"}, "")
+	published()
+
+	// chat does not change the version
+	room, _ = rooms.AddMessage(room.ID, RoomMessage{Author: "b-peer", Text: "hi"})
+	assert.Equal(t, int64(5), room.Version)
+	assert.Empty(t, published())
+
+	room, _ = rooms.TransferOwnership(room.ID, "a-peer", "b-peer")
+	assert.Equal(t, int64(8), room.Version)
+	changed = published()
+	require.Len(t, changed, 3)
+	assert.Equal(t, changeOwner, changed[2].Kind)
+	assert.Equal(t, "b-peer", changed[2].Owner)
+}
+
+func TestRoomChangeEvents(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	require.Nil(t, writeWsT(owner, helloMessage, map[string]interface{}{"version": 2, "capabilities": []string{capRoomEvents}}))
+	nextTypeWsT(t, owner, helloMessage)
+	roomID := createRoomT(t, owner)
+	legacy := dialWsT(t, s, "legacy", "legacy-peer")
+	defer legacy.Close()
+	require.Nil(t, writeWsT(legacy, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "legacy-peer"}))
+	readTypeWsT(t, legacy, roomUpdateMessage)
+	joined := readTypeWsT(t, owner, roomChangeMessage)
+	assert.Equal(t, changeJoined, joined["kind"])
+	assert.Equal(t, float64(1), joined["version"])
+
+	// joined peer gets snapshot even if it supports room events
+	peer := dialWsT(t, s, "user", "peer")
+	defer peer.Close()
+	require.Nil(t, writeWsT(peer, helloMessage, map[string]interface{}{"version": 2, "capabilities": []string{capRoomEvents}}))
+	nextTypeWsT(t, peer, helloMessage)
+	require.Nil(t, writeWsT(peer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer"}))
+	snapshot := readTypeWsT(t, peer, roomUpdateMessage)
+	assert.Equal(t, float64(2), snapshot["version"])
+	readTypeWsT(t, legacy, roomUpdateMessage)
+
+	require.Nil(t, writeWsT(legacy, leaveRoomMessage, map[string]interface{}{"id": roomID}))
+	left := readTypeWsT(t, peer, roomChangeMessage)
+	assert.Equal(t, map[string]interface{}{"roomId": roomID, "version": float64(3), "kind": changeLeft, "peerId": "legacy-peer", "userId": "legacy"}, left)
+
+	// client with missed changes asks for snapshot
+	require.Nil(t, writeWsT(peer, syncRoomMessage, map[string]interface{}{"id": roomID, "version": 1}))
+	snapshot = readTypeWsT(t, peer, roomUpdateMessage)
+	assert.Equal(t, float64(3), snapshot["version"])
+	assert.Len(t, snapshot["users"], 2)
+	require.Nil(t, writeWsT(legacy, syncRoomMessage, map[string]interface{}{"id": roomID, "version": 1}))
+	e := readTypeWsT(t, legacy, errorMessage)
+	assert.Equal(t, codeNotMember, e["code"])
+	// current version needs no snapshot
+	bts, _ := json.Marshal(Message{Type: syncRoomMessage, RequestID: "sync", Data: composeData(map[string]interface{}{"id": roomID, "version": 3})})
+	require.Nil(t, peer.WriteMessage(websocket.TextMessage, bts))
+	msg, err := readWsT(peer)
+	require.Nil(t, err)
+	assert.Equal(t, ackMessage, msg.Type)
+}
+
+func TestRoomChangesOrder(t *testing.T) {
+	s, rooms, _, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	peer := dialWsT(t, s, "user", "peer")
+	defer peer.Close()
+	require.Nil(t, writeWsT(peer, helloMessage, map[string]interface{}{"version": 2, "capabilities": []string{capRoomEvents}}))
+	nextTypeWsT(t, peer, helloMessage)
+	require.Nil(t, writeWsT(peer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer"}))
+	version := readTypeWsT(t, peer, roomUpdateMessage)["version"].(float64)
+
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rooms.JoinToRoom(roomID, User{ID: fmt.Sprint("user", i), PeerID: fmt.Sprint("peer", i)}, "")
+		}(i)
+	}
+	// snapshot requested meanwhile is ordered with the changes
+	require.Nil(t, writeWsT(peer, syncRoomMessage, map[string]interface{}{"id": roomID, "version": 0}))
+	last := version + writers
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for version < last {
+		msg, err := readWsT(peer)
+		require.Nil(t, err)
+		data := map[string]interface{}{}
+		json.Unmarshal(msg.Data, &data)
+		switch msg.Type {
+		case roomChangeMessage:
+			require.Equal(t, version+1, data["version"])
+			version++
+		case roomUpdateMessage:
+			require.True(t, data["version"].(float64) >= version)
+			version = data["version"].(float64)
+		}
+	}
+	wg.Wait()
+}
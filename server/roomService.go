@@ -1,155 +1,952 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"log"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/mikhail-angelov/websignal/auth"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // RoomMessage .
 type RoomMessage struct {
 	// set by service
+	ID        int64  `json:"id"` // increases within the room
 	Author    string `json:"author"`
+	AuthorID  string `json:"authorId"` // user id of the author, it is allowed to edit and delete the message
 	Text      string `json:"text"`
-	Timestamp string `json:"timestamp"`
+	Timestamp string `json:"timestamp"`        // RFC3339
+	Time      int64  `json:"time"`             // unix time in milliseconds
+	Edited    string `json:"edited,omitempty"` // RFC3339 time of the last edit
+
+	To        string              `json:"to,omitempty"`        // user id of the recipient of direct message
+	ReplyTo   int64               `json:"replyTo,omitempty"`   // id of the thread root message
+	Reactions map[string][]string `json:"reactions,omitempty"` // emoji to ids of users reacted with it, it is replaced on change
+	Deleted   bool                `json:"deleted,omitempty"`   // deleted thread root, it is kept without text while it has replies
 }
 
 //User in room
 type User struct {
-	Name       string `json:"name"`
-	ID         string `json:"id"`
-	PeerID     string `json:"peerId"`
-	Picture    []byte `json:"picture,omitempty"`
-	PictureURL string `json:"pictureUrl,omitempty"`
+	Name       string   `json:"name"`
+	ID         string   `json:"id"`
+	PeerID     string   `json:"peerId"`
+	PictureURL string   `json:"pictureUrl,omitempty"`
+	State      string   `json:"state,omitempty"` // empty for connected peer
+	Role       string   `json:"role,omitempty"`  // role in the room, see roles.go
+	Muted      []string `json:"muted,omitempty"` // media muted by moderator
+}
+
+// RoomSettings room options chosen by owner
+type RoomSettings struct {
+	Name     string   `json:"name,omitempty" validate:"max=128"`
+	Topic    string   `json:"topic,omitempty" validate:"max=512"`
+	Topology Topology `json:"topology,omitempty" validate:"oneof=mesh star auto"`
+	Private  bool     `json:"private,omitempty"`                   // private room admits users with invite only
+	MaxUsers int      `json:"maxUsers,omitempty" validate:"min=0"` // max number of peers, 0 means server default
+	Lobby    bool     `json:"lobby,omitempty"`                     // users wait in the lobby till moderator admits them
+	// set by service
+	Protected bool `json:"protected,omitempty"` // room has password
 }
 
 //Room node
 type Room struct {
 	ID        string        `json:"id"`
 	Owner     string        `json:"owner"`
+	Successor string        `json:"successor,omitempty"` // peer designated by owner to take the room over
 	Users     []User        `json:"users"`
 	Messages  []RoomMessage `json:"messages"`
-	timestamp time.Time
+	Settings  RoomSettings  `json:"settings"`
+	Banned    []string      `json:"banned,omitempty"`  // ids of users banned by moderators
+	Pending   []User        `json:"pending,omitempty"` // users waiting in the lobby
+	Created   time.Time     `json:"created"`
+	Version   int64         `json:"version"` // incremented by every room change
+}
+
+const (
+	defaultMaxUsers  = 50
+	snapshotMessages = 50  // messages of room snapshot sent to peers, older ones are requested by REST
+	maxMessagesPage  = 200 // max messages returned by GetMessages
+)
+
+var (
+	errRoomNotFound   = errors.New("does not exist")
+	errNotMember      = errors.New("is not in the room")
+	errInviteRequired = errors.New("is private, invite is required")
+	errInvalidInvite  = errors.New("invite is invalid, revoked or used up")
+	errWrongPassword  = errors.New("password is wrong")
+	errRoomFull       = errors.New("is full")
+	errCheckPassword  = errors.New("password has to be checked") // internal to JoinToRoom
+)
+
+// notOwnerError is returned when the user is not allowed to manage the room
+type notOwnerError struct {
+	user string
+}
+
+func (e notOwnerError) Error() string {
+	return e.user + " is not owner"
+}
+
+// roomEntry holds the room state, all changes of the room are serialized by the entry lock
+type roomEntry struct {
+	sync.Mutex
+	room     Room
+	links    map[linkKey]PeerLink   // peer connections planned for the room
+	invites  map[string]*inviteUses // active invites by id
+	password []byte                 // bcrypt password hash, empty if room has no password
+	ownerID  string                 // user id of the owner, it is kept when the owner peer is gone after restart
+	lastID   int64                  // id of the last added message
+	direct   []RoomMessage          // direct messages, they are not a part of the room history
+	active   time.Time              // time of the last change
+	indexed  []string               // user ids of the room in RoomService members index
+	closed   bool                   // set when room is removed from the service, late callers have to ignore it
+	closing  time.Time              // deadline announced to the peers by reaper, zero if the room is not closing
+
+	published roomState // state of the room when changes were recorded last time
+
+	saveMu    sync.Mutex // serializes writes of the room to the store, it is locked before the entry lock
+	dirty     bool       // room is changed since it was written to the store
+	scheduled bool       // write of the room to the store is scheduled
+}
+
+// inviteUses counts joins by the invite
+type inviteUses struct {
+	invite auth.Invite
+	uses   int
 }
 
 // RoomService room service
+// rooms map is guarded by mu, every room is guarded by its own entry lock,
+// mu is never held while waiting for an entry lock, so rooms are processed independently
+// settings have to be changed before the service is used
 type RoomService struct {
-	rooms map[string]*Room
+	DefaultTopology Topology      // topology of rooms created without one
+	MeshLimit       int           // auto topology uses mesh up to this number of peers
+	MaxUsers        int           // max number of peers of rooms created without limit, 0 means unlimited
+	IdleTTL         time.Duration // room without changes and online peers is closed after it, 0 disables it
+	MaxLifetime     time.Duration // room is closed after it even if it is active, 0 means unlimited
+	CloseWarning    time.Duration // peers are warned before the room is closed by MaxLifetime, 0 disables it
+	SaveDelay       time.Duration // room changes are written to the store after it, so a burst of changes is written once
+
+	mu    sync.RWMutex
+	rooms map[string]*roomEntry
+	store RoomStore
+	saves sync.WaitGroup // scheduled writes to the store
+
+	// publisher sends changes of the locked room, so every peer gets them in the order of versions
+	publisher func(room *Room, changes []RoomChange)
+
+	imu     sync.Mutex                 // guards members, it is locked after room entries and mu
+	members map[string]map[string]bool // user id to ids of rooms where the user has a peer
 }
 
-//NewRoomService create new service
+//NewRoomService create new service, rooms are kept in memory
 func NewRoomService() *RoomService {
 	return &RoomService{
-		rooms: make(map[string]*Room),
+		DefaultTopology: TopologyAuto,
+		MeshLimit:       defaultMeshLimit,
+		MaxUsers:        defaultMaxUsers,
+		IdleTTL:         defaultIdleTTL,
+		CloseWarning:    defaultCloseWarning,
+		SaveDelay:       defaultSaveDelay,
+		rooms:           make(map[string]*roomEntry),
+		store:           NewMemoryStore(),
+		members:         make(map[string]map[string]bool),
+	}
+}
+
+//NewRoomServiceWithStore create new service which keeps rooms in the store, stored rooms are loaded,
+//their peers are gone, so the rooms wait for the owner to join again
+func NewRoomServiceWithStore(store RoomStore) (*RoomService, error) {
+	r := NewRoomService()
+	r.store = store
+	rooms, err := store.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't load rooms")
+	}
+	for _, stored := range rooms {
+		e := restoreEntry(stored)
+		r.rooms[e.room.ID] = e
 	}
+	log.Printf("[INFO] %d rooms are loaded", len(rooms))
+	return r, nil
 }
 
-//GetRoom .
+//GetRoom returns room snapshot or nil
 func (r *RoomService) GetRoom(id string) *Room {
-	return r.rooms[id]
+	e := r.entry(id)
+	if e == nil {
+		return nil
+	}
+	e.Lock()
+	defer e.Unlock()
+	if e.closed {
+		return nil
+	}
+	return e.snapshot()
 }
 
-//CreateRoom creates room
-func (r *RoomService) CreateRoom(owner User) (*Room, error) {
+// withRoom calls fn with the locked room, so messages queued by fn are ordered with published changes,
+// fn must not keep the room, returns false if the room does not exist
+func (r *RoomService) withRoom(id string, fn func(room *Room)) bool {
+	e := r.entry(id)
+	if e == nil {
+		return false
+	}
+	e.Lock()
+	defer e.Unlock()
+	if e.closed {
+		return false
+	}
+	fn(&e.room)
+	return true
+}
+
+//CreateRoom creates room, users have to know the password to join the room if it is not empty,
+//owner without peer id is not in the room, the room waits for the owner to join it like restored room
+func (r *RoomService) CreateRoom(owner User, settings RoomSettings, password string) (*Room, error) {
+	if settings.Topology == "" {
+		settings.Topology = r.DefaultTopology
+	}
+	if settings.MaxUsers == 0 {
+		settings.MaxUsers = r.MaxUsers
+	}
+	settings.Protected = password != ""
+	owner.Role = roleOwner
+	var hash []byte
+	if password != "" {
+		// hashing is slow, it is done before rooms are locked
+		hash = hashPassword(password)
+	}
 	id := uuid.New().String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.rooms[id] != nil {
 		log.Printf("Room %s is already exist", id)
 		return nil, errors.Errorf("already exist")
 	}
-	room := &Room{
-		ID:        id,
-		Owner:     owner.PeerID,
-		Users:     []User{owner},
-		Messages:  []RoomMessage{},
-		timestamp: time.Now(),
+	e := &roomEntry{room: Room{
+		ID:       id,
+		Owner:    owner.PeerID,
+		Users:    []User{owner},
+		Messages: []RoomMessage{},
+		Settings: settings,
+		Created:  time.Now().UTC(),
+	}, links: map[linkKey]PeerLink{}, invites: map[string]*inviteUses{}, password: hash, ownerID: owner.ID}
+	if owner.PeerID == "" {
+		e.room.Users = []User{}
 	}
-	r.rooms[id] = room
-	return room, nil
+	e.published = stateOf(&e.room)
+	r.rooms[id] = e
+	r.persist(e)
+	return e.snapshot(), nil
 }
 
 //RemoveRoom remove room
 func (r *RoomService) RemoveRoom(id string, owner string) error {
-	if r.rooms[id] == nil {
-		log.Printf("Room %s does not exist", id)
-		return errors.Errorf("does not exist")
+	e, err := r.lock(id)
+	if err != nil {
+		return err
 	}
-	if r.rooms[id].Owner != owner {
+	defer e.Unlock()
+	if e.room.Owner != owner {
 		log.Printf("%s is not owner of room %s", owner, id)
-		return errors.Errorf(owner + " is not owner")
+		return notOwnerError{owner}
 	}
-	delete(r.rooms, id)
+	r.remove(e)
 	return nil
 }
 
-//JoinToRoom join to room
-func (r *RoomService) JoinToRoom(id string, user User) (*Room, error) {
-	room := r.rooms[id]
-	if room == nil {
-		log.Printf("Room %s does not exist", id)
-		return nil, errors.Errorf("does not exist")
+//GetRoomFor returns room snapshot to the user, private room is returned to its owner and members only
+func (r *RoomService) GetRoomFor(id string, userID string) (*Room, error) {
+	e, err := r.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	if e.room.Settings.Private && e.ownerID != userID && userRole(&e.room, userID) == "" {
+		return nil, errRoomNotFound
+	}
+	return e.snapshot(), nil
+}
+
+//UpdateSettings replaces settings of the room, the owner only may change them, the room password is not changed
+func (r *RoomService) UpdateSettings(id string, userID string, settings RoomSettings) (*Room, error) {
+	e, err := r.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	if e.ownerID != userID {
+		log.Printf("%s is not owner of room %s", userID, id)
+		return nil, notOwnerError{userID}
+	}
+	if settings.Topology == "" {
+		settings.Topology = r.DefaultTopology
+	}
+	if settings.MaxUsers == 0 {
+		settings.MaxUsers = r.MaxUsers
+	}
+	settings.Protected = e.room.Settings.Protected
+	e.room.Settings = settings
+	r.persist(e)
+	return e.snapshot(), nil
+}
+
+//DeleteRoom removes the room like RemoveRoom, but the owner is identified by user id,
+//returns the last room state to notify its peers
+func (r *RoomService) DeleteRoom(id string, userID string) (*Room, error) {
+	e, err := r.lock(id)
+	if err != nil {
+		return nil, err
 	}
-	room.Users = append(room.Users, user)
+	defer e.Unlock()
+	if e.ownerID != userID {
+		log.Printf("%s is not owner of room %s", userID, id)
+		return nil, notOwnerError{userID}
+	}
+	room := e.snapshot()
+	r.remove(e)
 	return room, nil
 }
 
-// LeaveRoom leave room
+//JoinToRoom join to public room, password is checked if the room has it,
+//the user is put to the lobby of the room with lobby, so the returned room does not have the user,
+//peer which is in the room already gets the room as is
+func (r *RoomService) JoinToRoom(id string, user User, password string) (*Room, error) {
+	var matched []byte // room password hash which the password matches
+	for {
+		e, err := r.lock(id)
+		if err != nil {
+			return nil, err
+		}
+		room, err := r.join(e, user, matched)
+		hash := e.password
+		e.Unlock()
+		if err != errCheckPassword {
+			return room, err
+		}
+		// bcrypt is slow on purpose, so the password is compared without the room lock,
+		// the room is checked again since it may be changed meanwhile
+		if !checkPassword(hash, password) {
+			log.Printf("wrong password for room %s", id)
+			return nil, errWrongPassword
+		}
+		matched = hash
+	}
+}
+
+// join adds the user to the locked room, errCheckPassword is returned if the password
+// has to be compared with the room password hash which differs from the matched one
+func (r *RoomService) join(e *roomEntry, user User, matched []byte) (*Room, error) {
+	if contains(e.room.Banned, user.ID) {
+		return nil, errBanned
+	}
+	if hasUser(e.room.Users, user.PeerID) {
+		return e.snapshot(), nil
+	}
+	if e.room.Owner == "" && user.ID == e.ownerID {
+		// owner is back to the restored room
+		e.room.Users = append(e.room.Users, user)
+		e.setOwner(user.PeerID)
+		r.persist(e)
+		return e.snapshot(), nil
+	}
+	if e.room.Settings.Private {
+		return nil, errInviteRequired
+	}
+	if len(e.password) != 0 && !bytes.Equal(e.password, matched) {
+		return nil, errCheckPassword
+	}
+	if e.isFull() {
+		return nil, errRoomFull
+	}
+	if e.room.Settings.Lobby && !hasRole(userRole(&e.room, user.ID), manageRole) {
+		e.knock(user)
+		r.persist(e)
+		return e.snapshot(), nil
+	}
+	user.Role = roleParticipant
+	e.room.Users = append(e.room.Users, user)
+	r.persist(e)
+	return e.snapshot(), nil
+}
+
+//JoinWithInvite join to room by invite, user gets the role of the invite, invite replaces password,
+//peer which is in the room already gets the room as is
+func (r *RoomService) JoinWithInvite(id string, user User, invite auth.Invite) (*Room, error) {
+	e, err := r.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	if contains(e.room.Banned, user.ID) {
+		return nil, errBanned
+	}
+	if hasUser(e.room.Users, user.PeerID) {
+		// the invite is not used again
+		return e.snapshot(), nil
+	}
+	active := e.invites[invite.ID]
+	if invite.RoomID != id || active == nil || (active.invite.MaxUses > 0 && active.uses >= active.invite.MaxUses) {
+		log.Printf("invalid invite %s to room %s", invite.ID, id)
+		return nil, errInvalidInvite
+	}
+	if e.isFull() {
+		return nil, errRoomFull
+	}
+	active.uses++
+	user.Role = active.invite.Role
+	if user.Role == "" {
+		user.Role = roleParticipant
+	}
+	e.room.Users = append(e.room.Users, user)
+	r.persist(e)
+	return e.snapshot(), nil
+}
+
+//CreateInvite registers new invite to the room, user has to own the room, the owner peer may be absent
+func (r *RoomService) CreateInvite(roomID string, userID string, maxUses int, role string) (auth.Invite, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return auth.Invite{}, err
+	}
+	defer e.Unlock()
+	if e.ownerID != userID {
+		log.Printf("%s is not owner of room %s", userID, roomID)
+		return auth.Invite{}, notOwnerError{userID}
+	}
+	invite := auth.Invite{ID: uuid.New().String(), RoomID: roomID, MaxUses: maxUses, Role: role}
+	e.invites[invite.ID] = &inviteUses{invite: invite}
+	r.persist(e)
+	return invite, nil
+}
+
+//RevokeInvite removes the invite, the invite cannot be used after that
+func (r *RoomService) RevokeInvite(roomID string, userID string, inviteID string) error {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return err
+	}
+	defer e.Unlock()
+	if e.ownerID != userID {
+		log.Printf("%s is not owner of room %s", userID, roomID)
+		return notOwnerError{userID}
+	}
+	if e.invites[inviteID] == nil {
+		return errInvalidInvite
+	}
+	delete(e.invites, inviteID)
+	r.persist(e)
+	return nil
+}
+
+// LeaveRoom leave room, returns nil room if it was the last peer and the room is removed,
+// the room is handed to the successor or the longest present peer when the owner leaves,
+// the room of known owner is kept without peers till the owner is back or the reaper closes it
 func (r *RoomService) LeaveRoom(roomID string, userID string) (*Room, error) {
-	room := r.rooms[roomID]
-	if room == nil {
-		log.Printf("Room %s does not exist", roomID)
-		return nil, errors.Errorf("does not exist")
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, err
 	}
-	room.Users = filterUsers(room.Users, func(u User) bool { return u.PeerID != userID })
-	if len(r.rooms[roomID].Users) == 0 {
-		r.RemoveRoom(roomID, room.Owner)
-		return nil, nil
+	defer e.Unlock()
+	if hasUser(e.room.Pending, userID) {
+		e.room.Pending = filterUsers(e.room.Pending, func(u User) bool { return u.PeerID != userID })
+		r.persist(e)
+		return e.snapshot(), nil
 	}
-	return room, nil
+	if !hasUser(e.room.Users, userID) {
+		return nil, errNotMember
+	}
+	e.room.Users = filterUsers(e.room.Users, func(u User) bool { return u.PeerID != userID })
+	if e.room.Successor == userID {
+		e.room.Successor = ""
+	}
+	if e.room.Owner == userID {
+		next := e.nextOwner()
+		if next == "" {
+			// fake users cannot manage the room
+			return r.vacate(e), nil
+		}
+		e.setOwner(next)
+		e.room.Successor = ""
+		log.Printf("Room %s is handed over from %s to %s", roomID, userID, e.room.Owner)
+	}
+	if len(e.room.Users) == 0 {
+		return r.vacate(e), nil
+	}
+	r.persist(e)
+	return e.snapshot(), nil
 }
 
-//AddFakeUser .
-func (r *RoomService) AddFakeUser(roomID string, user *User) (*Room, error) {
-	room := r.rooms[roomID]
-	if room == nil {
-		log.Printf("Room %s does not exist", roomID)
-		return nil, errors.Errorf("does not exist")
+// vacate handles locked room left by the last peer, the room of known owner is kept like restored one,
+// other rooms are removed and nil is returned
+func (r *RoomService) vacate(e *roomEntry) *Room {
+	if e.ownerID == "" {
+		r.remove(e)
+		return nil
 	}
-	room.Users = append(room.Users, *user)
-	return room, nil
+	e.room.Owner = ""
+	e.room.Successor = ""
+	e.room.Users = []User{}
+	e.room.Pending = nil
+	r.persist(e)
+	return e.snapshot()
+}
+
+//TransferOwnership hands the room over to another peer of the room
+func (r *RoomService) TransferOwnership(roomID string, owner string, peerID string) (*Room, error) {
+	return r.updateByOwner(roomID, owner, peerID, func(e *roomEntry) {
+		e.setOwner(peerID)
+		if e.room.Successor == peerID {
+			e.room.Successor = ""
+		}
+	})
 }
 
-//RemoveFakeUser .
-func (r *RoomService) RemoveFakeUser(roomID string, id string) (*Room, error) {
-	room := r.rooms[roomID]
-	if room == nil {
-		log.Printf("Room %s does not exist", roomID)
-		return nil, errors.Errorf("does not exist")
+//SetSuccessor designates the peer which takes the room over when the owner leaves
+func (r *RoomService) SetSuccessor(roomID string, owner string, peerID string) (*Room, error) {
+	return r.updateByOwner(roomID, owner, peerID, func(e *roomEntry) {
+		if peerID != owner {
+			e.room.Successor = peerID
+		}
+	})
+}
+
+//AddMessage appends chat message to the room, the added message with id is the last message of the returned room
+func (r *RoomService) AddMessage(roomID string, message RoomMessage) (*Room, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, err
 	}
-	room.Users = filterUsers(room.Users, func(u User) bool { return u.ID != id })
-	return room, nil
+	defer e.Unlock()
+	if !hasRole(peerRole(&e.room, message.Author), chatRole) {
+		return nil, errForbidden
+	}
+	if isMuted(&e.room, message.Author, mediaChat) {
+		return nil, errMuted
+	}
+	if message.ReplyTo != 0 {
+		i, err := e.findMessage(message.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		// reply to a reply belongs to the same thread
+		if root := e.room.Messages[i].ReplyTo; root != 0 {
+			message.ReplyTo = root
+		}
+	}
+	message.To = ""
+	e.room.Messages = append(e.room.Messages, e.stamp(message))
+	r.persist(e)
+	return e.snapshot(), nil
+}
+
+//GetMessages returns page of room messages to the user connected to the room, messages are ordered by id,
+//the page is the latest messages before the before id if after is 0, otherwise it is the earliest messages after the after id,
+//zero before means no upper bound, returns true if there are more messages out of the page limit
+func (r *RoomService) GetMessages(roomID string, userID string, before int64, after int64, limit int) ([]RoomMessage, bool, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer e.Unlock()
+	if userRole(&e.room, userID) == "" {
+		log.Printf("%s is not allowed to read messages of room %s", userID, roomID)
+		return nil, false, errForbidden
+	}
+	messages, hasMore := pageMessages(e.room.Messages, before, after, limit)
+	return messages, hasMore, nil
 }
 
-//GetUserRooms return list of rooms for particular user
-func (r *RoomService) GetUserRooms(id string) ([]Room, error) {
+//AddFakeUser adds user without connection, by user has to manage the room
+func (r *RoomService) AddFakeUser(roomID string, by string, user *User) (*Room, error) {
+	return r.update(roomID, func(room *Room) error {
+		if !hasRole(userRole(room, by), manageRole) {
+			return errForbidden
+		}
+		room.Users = append(room.Users, *user)
+		return nil
+	})
+}
+
+//RemoveFakeUser removes user without connection, by user has to manage the room
+func (r *RoomService) RemoveFakeUser(roomID string, by string, id string) (*Room, error) {
+	return r.update(roomID, func(room *Room) error {
+		if !hasRole(userRole(room, by), manageRole) {
+			return errForbidden
+		}
+		room.Users = filterUsers(room.Users, func(u User) bool { return u.ID != id || u.PeerID != "" })
+		return nil
+	})
+}
+
+//GetUserRooms return list of rooms where the user has a peer on any device
+func (r *RoomService) GetUserRooms(userID string) ([]Room, error) {
+	r.imu.Lock()
+	ids := []string{}
+	for id := range r.members[userID] {
+		ids = append(ids, id)
+	}
+	r.imu.Unlock()
+	sort.Strings(ids)
+	filtered := []Room{}
+	for _, id := range ids {
+		e, err := r.lock(id)
+		if err != nil {
+			continue // removed meanwhile
+		}
+		if userRole(&e.room, userID) != "" {
+			filtered = append(filtered, *e.snapshot())
+		}
+		e.Unlock()
+	}
+	return filtered, nil
+}
+
+//GetPeerRooms return list of rooms of the peer
+func (r *RoomService) GetPeerRooms(peerID string) ([]Room, error) {
 	filtered := []Room{}
-	for _, room := range r.rooms {
-		if hasUser(room.Users, id) {
-			filtered = append(filtered, *room)
+	for _, e := range r.entries() {
+		e.Lock()
+		if !e.closed && hasUser(e.room.Users, peerID) {
+			filtered = append(filtered, *e.snapshot())
 		}
+		e.Unlock()
 	}
 	return filtered, nil
 }
 
-// RoomToMap .
+//SetPeerState updates connection state of the peer in all its rooms, returns updated rooms
+func (r *RoomService) SetPeerState(peerID string, state string) []Room {
+	updated := []Room{}
+	for _, e := range r.entries() {
+		e.Lock()
+		if !e.closed && hasUser(e.room.Users, peerID) {
+			for i := range e.room.Users {
+				if e.room.Users[i].PeerID == peerID {
+					e.room.Users[i].State = state
+				}
+			}
+			r.persist(e)
+			updated = append(updated, *e.snapshot())
+		}
+		e.Unlock()
+	}
+	return updated
+}
+
+//Replan updates peer connections of the room according to its topology,
+//returns connections which have to be opened and closed
+func (r *RoomService) Replan(roomID string) ([]PeerLink, []PeerLink, error) {
+	e, err := r.lock(roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer e.Unlock()
+	peers := []string{}
+	for _, u := range e.room.Users {
+		if u.PeerID != "" { // fake users have no connection
+			peers = append(peers, u.PeerID)
+		}
+	}
+	planned := planLinks(e.room.Settings.Topology, peers, e.room.Owner, r.MeshLimit)
+	open, closed := diffLinks(e.links, planned)
+	e.links = planned
+	return open, closed, nil
+}
+
+// RoomSnapshot is the room sent to its peers, it has the latest messages only
+type RoomSnapshot struct {
+	ID              string        `json:"id"`
+	Owner           string        `json:"owner"`
+	Successor       string        `json:"successor"`
+	Users           []User        `json:"users"`
+	Messages        []RoomMessage `json:"messages"`
+	HasMoreMessages bool          `json:"hasMoreMessages"` // older messages are requested by REST
+	Settings        RoomSettings  `json:"settings"`
+	Banned          []string      `json:"banned"`
+	Pending         []User        `json:"pending,omitempty"` // lobby is sent to room managers only
+	Created         time.Time     `json:"created"`
+	Version         int64         `json:"version"`
+}
+
+// RoomToMap renders room snapshot, it has the latest messages only, lobby is not rendered
 func RoomToMap(room *Room) json.RawMessage {
-	data := map[string]interface{}{"id": room.ID, "owner": room.Owner, "users": room.Users, "messages": room.Messages}
-	bts, _ := json.Marshal(data)
+	return roomToMap(room, false)
+}
+
+// RoomToMapFor renders room snapshot to the peer, lobby is rendered to room managers only
+func RoomToMapFor(room *Room, peerID string) json.RawMessage {
+	return roomToMap(room, hasRole(peerRole(room, peerID), manageRole))
+}
+
+func roomToMap(room *Room, lobby bool) json.RawMessage {
+	messages := room.Messages
+	if len(messages) > snapshotMessages {
+		messages = messages[len(messages)-snapshotMessages:]
+	}
+	snapshot := RoomSnapshot{ID: room.ID, Owner: room.Owner, Successor: room.Successor, Users: room.Users,
+		Messages: messages, HasMoreMessages: len(messages) < len(room.Messages), Settings: room.Settings, Banned: room.Banned,
+		Created: room.Created, Version: room.Version}
+	if lobby {
+		snapshot.Pending = room.Pending
+	}
+	bts, _ := json.Marshal(snapshot)
 	return bts
 }
 
+func (r *RoomService) entry(id string) *roomEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rooms[id]
+}
+
+func (r *RoomService) entries() []*roomEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]*roomEntry, 0, len(r.rooms))
+	for _, e := range r.rooms {
+		list = append(list, e)
+	}
+	return list
+}
+
+// update applies fn to the room under the room lock and returns the room snapshot
+func (r *RoomService) update(id string, fn func(room *Room) error) (*Room, error) {
+	e, err := r.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	if err := fn(&e.room); err != nil {
+		return nil, err
+	}
+	r.persist(e)
+	return e.snapshot(), nil
+}
+
+// updateByOwner applies fn to the room if owner manages it and peerID is a peer of the room
+func (r *RoomService) updateByOwner(id string, owner string, peerID string, fn func(e *roomEntry)) (*Room, error) {
+	e, err := r.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unlock()
+	if e.room.Owner != owner {
+		log.Printf("%s is not owner of room %s", owner, id)
+		return nil, notOwnerError{owner}
+	}
+	if peerID == "" || !hasUser(e.room.Users, peerID) {
+		return nil, errors.Wrapf(errNotMember, "peer %s", peerID)
+	}
+	fn(e)
+	r.persist(e)
+	return e.snapshot(), nil
+}
+
+// lock returns locked room entry, caller has to unlock it
+func (r *RoomService) lock(id string) (*roomEntry, error) {
+	e := r.entry(id)
+	if e != nil {
+		e.Lock()
+		if !e.closed {
+			return e, nil
+		}
+		e.Unlock()
+	}
+	log.Printf("Room %s does not exist", id)
+	return nil, errRoomNotFound
+}
+
+// remove deletes locked room from the service
+func (r *RoomService) remove(e *roomEntry) {
+	e.closed = true
+	r.mu.Lock()
+	delete(r.rooms, e.room.ID)
+	r.mu.Unlock()
+	r.index(e)
+	r.schedule(e)
+}
+
+// persist publishes changes of locked room and schedules its write to the store,
+// the room is kept in memory if the write fails, every saved change is room activity
+func (r *RoomService) persist(e *roomEntry) {
+	e.active = time.Now()
+	if changes := e.publish(); len(changes) > 0 && r.publisher != nil {
+		r.publisher(&e.room, changes)
+	}
+	r.index(e)
+	r.schedule(e)
+}
+
+// schedule writes locked room to the store after SaveDelay, the room is not locked during the write
+func (r *RoomService) schedule(e *roomEntry) {
+	e.dirty = true
+	if e.scheduled {
+		return
+	}
+	e.scheduled = true
+	r.saves.Add(1)
+	time.AfterFunc(r.SaveDelay, func() {
+		defer r.saves.Done()
+		r.save(e)
+	})
+}
+
+// save writes changed room to the store or deletes closed room from it
+func (r *RoomService) save(e *roomEntry) {
+	e.saveMu.Lock()
+	defer e.saveMu.Unlock()
+	e.Lock()
+	id, dirty, closed := e.room.ID, e.dirty, e.closed
+	var stored StoredRoom
+	if dirty && !closed {
+		stored = e.stored()
+	}
+	e.dirty, e.scheduled = false, false
+	e.Unlock()
+	switch {
+	case closed:
+		if err := r.store.Delete(id); err != nil {
+			log.Printf("[WARN] can't delete room %s from store, %v", id, err)
+		}
+	case dirty:
+		if err := r.store.Save(stored); err != nil {
+			log.Printf("[WARN] can't save room %s, %v", id, err)
+		}
+	}
+}
+
+//Flush writes changed rooms to the store and waits for scheduled writes, it is called on shutdown
+func (r *RoomService) Flush() {
+	for _, e := range r.entries() {
+		r.save(e)
+	}
+	r.saves.Wait()
+}
+
+// index updates members index with users of locked room, closed room has no users
+func (r *RoomService) index(e *roomEntry) {
+	users := []string{}
+	if !e.closed {
+		for _, u := range e.room.Users {
+			if u.PeerID != "" && !contains(users, u.ID) {
+				users = append(users, u.ID)
+			}
+		}
+	}
+	r.imu.Lock()
+	defer r.imu.Unlock()
+	for _, id := range e.indexed {
+		if !contains(users, id) {
+			delete(r.members[id], e.room.ID)
+			if len(r.members[id]) == 0 {
+				delete(r.members, id)
+			}
+		}
+	}
+	for _, id := range users {
+		if r.members[id] == nil {
+			r.members[id] = map[string]bool{}
+		}
+		r.members[id][e.room.ID] = true
+	}
+	e.indexed = users
+}
+
+// stored returns room state for the store
+func (e *roomEntry) stored() StoredRoom {
+	stored := StoredRoom{Version: storeVersion, Room: *e.snapshot(), OwnerID: e.ownerID, Password: e.password, Created: e.room.Created, LastMessageID: e.lastID,
+		Direct: append([]RoomMessage{}, e.direct...), Active: e.active}
+	for _, active := range e.invites {
+		stored.Invites = append(stored.Invites, StoredInvite{Invite: active.invite, Uses: active.uses})
+	}
+	return stored
+}
+
+// restoreEntry makes room entry of the stored room, peers of the room are not restored
+func restoreEntry(stored StoredRoom) *roomEntry {
+	e := &roomEntry{room: stored.Room, links: map[linkKey]PeerLink{}, invites: map[string]*inviteUses{},
+		password: stored.Password, ownerID: stored.OwnerID, lastID: stored.LastMessageID, direct: stored.Direct, active: stored.Active}
+	if e.active.IsZero() {
+		e.active = time.Now()
+	}
+	e.room.Owner = ""
+	e.room.Successor = ""
+	e.room.Users = []User{}
+	e.room.Pending = nil
+	e.room.Created = stored.Created
+	if e.room.Messages == nil {
+		e.room.Messages = []RoomMessage{}
+	}
+	for _, invite := range stored.Invites {
+		e.invites[invite.Invite.ID] = &inviteUses{invite: invite.Invite, uses: invite.Uses}
+	}
+	e.published = stateOf(&e.room)
+	return e
+}
+
+// snapshot copies room state, so it can be read without the lock
+func (e *roomEntry) snapshot() *Room {
+	room := e.room
+	room.Users = append([]User{}, e.room.Users...)
+	room.Messages = append([]RoomMessage{}, e.room.Messages...)
+	room.Banned = append([]string{}, e.room.Banned...)
+	room.Pending = append([]User{}, e.room.Pending...)
+	return &room
+}
+
+// isFull checks that one more peer cannot join the room, fake users are not counted
+func (e *roomEntry) isFull() bool {
+	if e.room.Settings.MaxUsers <= 0 {
+		return false
+	}
+	peers := 0
+	for _, u := range e.room.Users {
+		if u.PeerID != "" {
+			peers++
+		}
+	}
+	return peers >= e.room.Settings.MaxUsers
+}
+
+// passwordCost is bcrypt cost of room passwords
+var passwordCost = bcrypt.DefaultCost
+
+// hashPassword returns bcrypt hash of the password
+func hashPassword(password string) []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		log.Printf("[WARN] cannot hash password, %v", err)
+	}
+	return hash
+}
+
+// checkPassword compares the password with bcrypt hash
+func checkPassword(hash []byte, password string) bool {
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// nextOwner returns the successor or the longest present peer, fake users are skipped
+func (e *roomEntry) nextOwner() string {
+	if e.room.Successor != "" && hasUser(e.room.Users, e.room.Successor) {
+		return e.room.Successor
+	}
+	for _, u := range e.room.Users {
+		if u.PeerID != "" {
+			return u.PeerID
+		}
+	}
+	return ""
+}
+
 func filterUsers(users []User, fn func(u User) bool) []User {
 	filtered := []User{}
 	for _, u := range users {
@@ -1,16 +1,26 @@
 package server
 
 import (
+	"encoding/json"
+	"fmt"
+	"sync"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
+func init() {
+	// hashing with default cost is slow with race detector
+	passwordCost = bcrypt.MinCost
+}
+
 func TestCreateRoom(t *testing.T) {
 	rooms := NewRoomService()
 	user := User{ID: "test", PeerID: "test-peer", Name: "test"}
-	room, err := rooms.CreateRoom(user)
+	room, err := rooms.CreateRoom(user, RoomSettings{}, "")
 	require.NoError(t, err)
 	require.Equal(t, room.Owner, user.PeerID)
 }
@@ -18,7 +28,7 @@ func TestCreateRoom(t *testing.T) {
 func TestRemoveRoom(t *testing.T) {
 	rooms := NewRoomService()
 	user := User{ID: "test", PeerID: "test-peer", Name: "test"}
-	room, err := rooms.CreateRoom(user)
+	room, err := rooms.CreateRoom(user, RoomSettings{}, "")
 
 	err = rooms.RemoveRoom("test1", "test")
 	require.EqualError(t, err, "does not exist")
@@ -31,19 +41,266 @@ func TestRemoveRoom(t *testing.T) {
 func TestJoinLeaveRoom(t *testing.T) {
 	roomService := NewRoomService()
 	user := User{ID: "test", PeerID: "test-peer", Name: "test"}
-	room, err := roomService.CreateRoom(user)
+	room, err := roomService.CreateRoom(user, RoomSettings{}, "")
 	require.NoError(t, err)
 
 	user2 := User{ID: "test2", PeerID: "test-peer2", Name: "test2"}
-	room, err = roomService.JoinToRoom(room.ID, user2)
+	room, err = roomService.JoinToRoom(room.ID, user2, "")
 	require.NoError(t, err)
-	rooms, err := roomService.GetUserRooms(user2.PeerID)
+	rooms, err := roomService.GetPeerRooms(user2.PeerID)
 	require.NoError(t, err)
 	assert.Equal(t, 1, len(rooms))
 	assert.Equal(t, user.PeerID, rooms[0].Owner)
 
 	_, err = roomService.LeaveRoom(room.ID, user2.PeerID)
 	require.NoError(t, err)
-	rooms, _ = roomService.GetUserRooms(user2.PeerID)
+	rooms, _ = roomService.GetPeerRooms(user2.PeerID)
 	assert.Equal(t, 0, len(rooms))
+	_, err = roomService.LeaveRoom(room.ID, user2.PeerID)
+	require.Equal(t, errNotMember, err)
+}
+
+func TestConcurrentJoinLeaveRoom(t *testing.T) {
+	roomService := NewRoomService()
+	roomService.MaxUsers = 0 // all users may be in the room at once
+	owner := User{ID: "owner", PeerID: "owner-peer", Name: "owner"}
+	room, err := roomService.CreateRoom(owner, RoomSettings{}, "")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := User{ID: fmt.Sprintf("user%d", i), PeerID: fmt.Sprintf("peer%d", i)}
+			_, err := roomService.JoinToRoom(room.ID, user, "")
+			assert.NoError(t, err)
+			_, err = roomService.AddMessage(room.ID, RoomMessage{Author: user.PeerID, Text: "hi"})
+			assert.NoError(t, err)
+			rooms, _ := roomService.GetPeerRooms(user.PeerID)
+			assert.Equal(t, 1, len(rooms))
+			RoomToMap(&rooms[0])
+			_, err = roomService.LeaveRoom(room.ID, user.PeerID)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	room = roomService.GetRoom(room.ID)
+	require.NotNil(t, room)
+	assert.Equal(t, 1, len(room.Users))
+	assert.Equal(t, 200, len(room.Messages))
+
+	// room waits for the owner
+	_, err = roomService.LeaveRoom(room.ID, owner.PeerID)
+	require.NoError(t, err)
+	room = roomService.GetRoom(room.ID)
+	require.NotNil(t, room)
+	assert.Empty(t, room.Users)
+	assert.Empty(t, room.Owner)
+	room, err = roomService.JoinToRoom(room.ID, owner, "")
+	require.NoError(t, err)
+	assert.Equal(t, owner.PeerID, room.Owner)
+}
+
+func TestOwnerHandOff(t *testing.T) {
+	roomService := NewRoomService()
+	room, err := roomService.CreateRoom(User{ID: "a", PeerID: "a"}, RoomSettings{}, "")
+	require.NoError(t, err)
+	roomService.AddFakeUser(room.ID, "a", &User{ID: "fake"})
+	for _, id := range []string{"b", "c", "d"} {
+		roomService.JoinToRoom(room.ID, User{ID: id, PeerID: id}, "")
+	}
+
+	// only owner manages the room
+	_, err = roomService.TransferOwnership(room.ID, "b", "c")
+	require.EqualError(t, err, "b is not owner")
+	_, err = roomService.SetSuccessor(room.ID, "a", "none")
+	require.Equal(t, errNotMember, errors.Cause(err))
+	_, err = roomService.SetSuccessor(room.ID, "a", "fake")
+	require.Equal(t, errNotMember, errors.Cause(err))
+
+	// designated successor takes the room over
+	updated, err := roomService.SetSuccessor(room.ID, "a", "c")
+	require.NoError(t, err)
+	assert.Equal(t, "a", updated.Owner)
+	assert.Equal(t, "c", updated.Successor)
+	updated, err = roomService.LeaveRoom(room.ID, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "c", updated.Owner)
+	assert.Empty(t, updated.Successor)
+
+	// longest present peer takes the room over
+	updated, err = roomService.LeaveRoom(room.ID, "c")
+	require.NoError(t, err)
+	assert.Equal(t, "b", updated.Owner)
+
+	updated, err = roomService.TransferOwnership(room.ID, "b", "d")
+	require.NoError(t, err)
+	assert.Equal(t, "d", updated.Owner)
+	require.EqualError(t, roomService.RemoveRoom(room.ID, "b"), "b is not owner")
+
+	// room is emptied when only fake users are left, it waits for the owner
+	_, err = roomService.LeaveRoom(room.ID, "d")
+	require.NoError(t, err)
+	updated, err = roomService.LeaveRoom(room.ID, "b")
+	require.NoError(t, err)
+	require.NotNil(t, updated)
+	assert.Empty(t, updated.Users)
+	assert.Empty(t, updated.Owner)
+	updated, err = roomService.JoinToRoom(room.ID, User{ID: "b", PeerID: "b2"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "b2", updated.Owner)
+
+	// room without known owner is removed
+	roomService.entry(room.ID).ownerID = ""
+	updated, err = roomService.LeaveRoom(room.ID, "b2")
+	require.NoError(t, err)
+	assert.Nil(t, updated)
+	assert.Nil(t, roomService.GetRoom(room.ID))
+}
+
+func TestPrivateRoomInvites(t *testing.T) {
+	roomService := NewRoomService()
+	room, err := roomService.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{Private: true}, "")
+	require.NoError(t, err)
+	_, err = roomService.JoinToRoom(room.ID, User{ID: "a", PeerID: "a"}, "")
+	require.Equal(t, errInviteRequired, err)
+
+	_, err = roomService.CreateInvite(room.ID, "owner-peer", 1, "")
+	require.EqualError(t, err, "owner-peer is not owner")
+	invite, err := roomService.CreateInvite(room.ID, "owner", 1, "viewer")
+	require.NoError(t, err)
+	assert.Equal(t, room.ID, invite.RoomID)
+
+	updated, err := roomService.JoinWithInvite(room.ID, User{ID: "a", PeerID: "a"}, invite)
+	require.NoError(t, err)
+	assert.Equal(t, "viewer", updated.Users[1].Role)
+	// invite is used up
+	_, err = roomService.JoinWithInvite(room.ID, User{ID: "b", PeerID: "b"}, invite)
+	require.Equal(t, errInvalidInvite, err)
+
+	other, _ := roomService.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{Private: true}, "")
+	_, err = roomService.JoinWithInvite(other.ID, User{ID: "b", PeerID: "b"}, invite)
+	require.Equal(t, errInvalidInvite, err)
+
+	invite, _ = roomService.CreateInvite(room.ID, "owner", 0, "")
+	require.EqualError(t, roomService.RevokeInvite(room.ID, "a", invite.ID), "a is not owner")
+	require.NoError(t, roomService.RevokeInvite(room.ID, "owner", invite.ID))
+	require.Equal(t, errInvalidInvite, roomService.RevokeInvite(room.ID, "owner", invite.ID))
+	_, err = roomService.JoinWithInvite(room.ID, User{ID: "b", PeerID: "b"}, invite)
+	require.Equal(t, errInvalidInvite, err)
+}
+
+func TestRoomPasswordAndCapacity(t *testing.T) {
+	roomService := NewRoomService()
+	roomService.MaxUsers = 3
+	room, err := roomService.CreateRoom(User{ID: "owner", PeerID: "owner"}, RoomSettings{}, "secret")
+	require.NoError(t, err)
+	assert.True(t, room.Settings.Protected)
+	assert.Equal(t, 3, room.Settings.MaxUsers)
+	assert.NotContains(t, string(RoomToMap(room)), "secret")
+	_, err = bcrypt.Cost(roomService.entry(room.ID).password)
+	assert.NoError(t, err)
+
+	_, err = roomService.JoinToRoom(room.ID, User{ID: "a", PeerID: "a"}, "")
+	require.Equal(t, errWrongPassword, err)
+	_, err = roomService.JoinToRoom(room.ID, User{ID: "a", PeerID: "a"}, "Secret")
+	require.Equal(t, errWrongPassword, err)
+	_, err = roomService.JoinToRoom(room.ID, User{ID: "a", PeerID: "a"}, "secret")
+	require.NoError(t, err)
+	// repeated join keeps the only place of the peer
+	room, err = roomService.JoinToRoom(room.ID, User{ID: "a", PeerID: "a"}, "secret")
+	require.NoError(t, err)
+	assert.Len(t, room.Users, 2)
+	// fake users are not counted
+	_, err = roomService.AddFakeUser(room.ID, "owner", &User{ID: "fake"})
+	require.NoError(t, err)
+	_, err = roomService.JoinToRoom(room.ID, User{ID: "b", PeerID: "b"}, "secret")
+	require.NoError(t, err)
+	_, err = roomService.JoinToRoom(room.ID, User{ID: "c", PeerID: "c"}, "secret")
+	require.Equal(t, errRoomFull, err)
+
+	// invite replaces password but not the limit
+	invite, err := roomService.CreateInvite(room.ID, "owner", 0, "")
+	require.NoError(t, err)
+	_, err = roomService.JoinWithInvite(room.ID, User{ID: "c", PeerID: "c"}, invite)
+	require.Equal(t, errRoomFull, err)
+	roomService.LeaveRoom(room.ID, "b")
+	_, err = roomService.JoinWithInvite(room.ID, User{ID: "c", PeerID: "c"}, invite)
+	require.NoError(t, err)
+	// repeated join does not use the invite
+	limited, err := roomService.CreateInvite(room.ID, "owner", 1, "")
+	require.NoError(t, err)
+	roomService.LeaveRoom(room.ID, "c")
+	_, err = roomService.JoinWithInvite(room.ID, User{ID: "c", PeerID: "c"}, limited)
+	require.NoError(t, err)
+	room, err = roomService.JoinWithInvite(room.ID, User{ID: "c", PeerID: "c"}, limited)
+	require.NoError(t, err)
+	assert.Len(t, room.Users, 4)
+
+	room, err = roomService.CreateRoom(User{ID: "owner", PeerID: "owner"}, RoomSettings{MaxUsers: 1}, "")
+	require.NoError(t, err)
+	assert.False(t, room.Settings.Protected)
+	_, err = roomService.JoinToRoom(room.ID, User{ID: "a", PeerID: "a"}, "any")
+	require.Equal(t, errRoomFull, err)
+}
+
+func TestMessageHistory(t *testing.T) {
+	roomService := NewRoomService()
+	room, _ := roomService.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{}, "")
+	for i := 1; i <= snapshotMessages+10; i++ {
+		room, _ = roomService.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: fmt.Sprint(i)})
+		require.Equal(t, int64(i), room.Messages[len(room.Messages)-1].ID)
+	}
+
+	messages, hasMore, err := roomService.GetMessages(room.ID, "owner", 0, 0, 5)
+	require.NoError(t, err)
+	assert.True(t, hasMore)
+	assert.Equal(t, int64(56), messages[0].ID)
+	assert.Equal(t, int64(60), messages[4].ID)
+	messages, hasMore, _ = roomService.GetMessages(room.ID, "owner", 4, 0, 5)
+	assert.False(t, hasMore)
+	assert.Len(t, messages, 3)
+	messages, hasMore, _ = roomService.GetMessages(room.ID, "owner", 0, 10, 5)
+	assert.True(t, hasMore)
+	assert.Equal(t, int64(11), messages[0].ID)
+	messages, hasMore, _ = roomService.GetMessages(room.ID, "owner", 0, 58, 5)
+	assert.False(t, hasMore)
+	assert.Len(t, messages, 2)
+
+	_, _, err = roomService.GetMessages(room.ID, "stranger", 0, 0, 5)
+	assert.Equal(t, errForbidden, err)
+	_, _, err = roomService.GetMessages("none", "owner", 0, 0, 5)
+	assert.Equal(t, errRoomNotFound, err)
+
+	snapshot := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(RoomToMap(room), &snapshot))
+	assert.Len(t, snapshot["messages"], snapshotMessages)
+	assert.Equal(t, true, snapshot["hasMoreMessages"])
+}
+
+func TestUserRoomsIndex(t *testing.T) {
+	roomService := NewRoomService()
+	room, _ := roomService.CreateRoom(User{ID: "a", PeerID: "a-laptop"}, RoomSettings{}, "")
+	roomService.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-phone"}, "")
+	roomService.JoinToRoom(room.ID, User{ID: "b", PeerID: "b-peer"}, "")
+	roomService.AddFakeUser(room.ID, "a", &User{ID: "fake"})
+
+	rooms, _ := roomService.GetUserRooms("a")
+	assert.Len(t, rooms, 1)
+	rooms, _ = roomService.GetUserRooms("fake")
+	assert.Empty(t, rooms)
+	// the user is in the room while any of its peers is
+	roomService.LeaveRoom(room.ID, "a-laptop")
+	rooms, _ = roomService.GetUserRooms("a")
+	assert.Len(t, rooms, 1)
+	roomService.LeaveRoom(room.ID, "a-phone")
+	rooms, _ = roomService.GetUserRooms("a")
+	assert.Empty(t, rooms)
+
+	roomService.LeaveRoom(room.ID, "b-peer")
+	rooms, _ = roomService.GetUserRooms("b")
+	assert.Empty(t, rooms)
+	assert.Empty(t, roomService.members)
 }
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikhail-angelov/websignal/auth"
+	"github.com/pkg/errors"
+)
+
+// storeVersion is the current schema version of stored rooms, the first one is 1
+const storeVersion = 3
+
+// defaultSaveDelay is delay of writing room changes to the store
+const defaultSaveDelay = time.Second
+
+// RoomStore keeps rooms between restarts, RoomService saves room changes to the store in background
+// and loads all rooms on start, calls for different rooms may be concurrent
+type RoomStore interface {
+	Load() ([]StoredRoom, error)
+	Save(room StoredRoom) error
+	Delete(id string) error
+}
+
+// StoredRoom is room state kept by RoomStore
+type StoredRoom struct {
+	Version  int            `json:"version"`
+	Room     Room           `json:"room"`
+	OwnerID  string         `json:"ownerId"`            // user id of the owner, peers are not restored
+	Password []byte         `json:"password,omitempty"` // bcrypt hash
+	Invites  []StoredInvite `json:"invites,omitempty"`
+	Created  time.Time      `json:"created"`
+
+	LastMessageID int64         `json:"lastMessageId"`
+	Direct        []RoomMessage `json:"direct,omitempty"` // direct messages between room users
+	Active        time.Time     `json:"active"`           // time of the last change
+}
+
+// StoredInvite is active room invite
+type StoredInvite struct {
+	Invite auth.Invite `json:"invite"`
+	Uses   int         `json:"uses"`
+}
+
+// migration upgrades stored room document of the previous version
+type migration func(doc map[string]interface{}) error
+
+// migrations[i] upgrades document of version i+1 to version i+2
+var migrations = []migration{
+	// version 2 adds message ids
+	func(doc map[string]interface{}) error {
+		room, _ := doc["room"].(map[string]interface{})
+		messages, _ := room["messages"].([]interface{})
+		for i, m := range messages {
+			if message, ok := m.(map[string]interface{}); ok {
+				message["id"] = i + 1
+			}
+		}
+		doc["lastMessageId"] = len(messages)
+		return nil
+	},
+	// version 3 replaces time.Time.String() timestamps of messages with RFC3339 and unix time
+	func(doc map[string]interface{}) error {
+		room, _ := doc["room"].(map[string]interface{})
+		messages, _ := room["messages"].([]interface{})
+		for _, m := range messages {
+			message, ok := m.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			timestamp, _ := message["timestamp"].(string)
+			// strip monotonic clock reading
+			timestamp = strings.SplitN(timestamp, " m=", 2)[0]
+			t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", timestamp)
+			if err != nil {
+				log.Printf("[WARN] invalid timestamp %q of message %v, %v", timestamp, message["id"], err)
+				continue
+			}
+			message["timestamp"] = t.UTC().Format(time.RFC3339Nano)
+			message["time"] = t.UnixNano() / int64(time.Millisecond)
+		}
+		return nil
+	},
+}
+
+// migrate upgrades stored room document to the current version, returns true if it is changed
+func migrate(doc map[string]interface{}) (bool, error) {
+	version := 0
+	if v, ok := doc["version"].(float64); ok {
+		version = int(v)
+	}
+	if version < 1 || version > storeVersion {
+		return false, errors.Errorf("unknown version %d, max version is %d", version, storeVersion)
+	}
+	migrated := version < storeVersion
+	for ; version < storeVersion; version++ {
+		if err := migrations[version-1](doc); err != nil {
+			return false, errors.Wrapf(err, "migration to version %d", version+1)
+		}
+		doc["version"] = version + 1
+	}
+	return migrated, nil
+}
+
+// MemoryStore keeps rooms in memory, they are lost on restart
+type MemoryStore struct {
+	mu    sync.Mutex
+	rooms map[string]StoredRoom
+}
+
+// NewMemoryStore creates in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{rooms: map[string]StoredRoom{}}
+}
+
+// Load returns all rooms
+func (s *MemoryStore) Load() ([]StoredRoom, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := []StoredRoom{}
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// Save keeps the room
+func (s *MemoryStore) Save(room StoredRoom) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms[room.Room.ID] = room
+	return nil
+}
+
+// Delete removes the room
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rooms, id)
+	return nil
+}
+
+// FileStore keeps every room in its own json file of the directory,
+// files are synced and replaced atomically, so a crash never leaves partially written room
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates store in the directory, the directory is created if it does not exist
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "can't create store directory %s", dir)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Load reads all rooms, rooms of older versions are migrated and saved back
+func (s *FileStore) Load() ([]StoredRoom, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list rooms")
+	}
+	rooms := []StoredRoom{}
+	for _, file := range files {
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't read room %s", file)
+		}
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal(bts, &doc); err != nil {
+			return nil, errors.Wrapf(err, "can't parse room %s", file)
+		}
+		migrated, err := migrate(doc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't migrate room %s", file)
+		}
+		room := StoredRoom{}
+		if bts, err = json.Marshal(doc); err == nil {
+			err = json.Unmarshal(bts, &room)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't decode room %s", file)
+		}
+		if room.Room.ID == "" {
+			room.Room.ID = strings.TrimSuffix(filepath.Base(file), ".json")
+		}
+		if migrated {
+			log.Printf("[INFO] room %s is migrated to version %d", room.Room.ID, storeVersion)
+			if err := s.Save(room); err != nil {
+				return nil, err
+			}
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// Save writes the room file
+func (s *FileStore) Save(room StoredRoom) error {
+	file, err := s.file(room.Room.ID)
+	if err != nil {
+		return err
+	}
+	bts, err := json.Marshal(room)
+	if err != nil {
+		return errors.Wrapf(err, "can't encode room %s", room.Room.ID)
+	}
+	tmp := file + ".tmp"
+	if err := writeSync(tmp, bts); err != nil {
+		return errors.Wrapf(err, "can't write room %s", room.Room.ID)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return errors.Wrapf(err, "can't replace room %s", room.Room.ID)
+	}
+	// rename is durable when the directory is synced
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return errors.Wrapf(err, "can't sync room %s", room.Room.ID)
+	}
+	defer dir.Close()
+	return errors.Wrapf(dir.Sync(), "can't sync room %s", room.Room.ID)
+}
+
+// writeSync writes the file and flushes it to disk
+func writeSync(file string, bts []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(bts); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Delete removes the room file
+func (s *FileStore) Delete(id string) error {
+	file, err := s.file(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "can't remove room %s", id)
+	}
+	return nil
+}
+
+func (s *FileStore) file(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", errors.Errorf("invalid room id %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempDirT(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "rooms")
+	require.NoError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestFileStore(t *testing.T) {
+	dir, cleanup := tempDirT(t)
+	defer cleanup()
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	room := StoredRoom{Version: storeVersion, Room: Room{ID: "room1", Messages: []RoomMessage{{Author: "a", Text: "hi"}}}, OwnerID: "a"}
+	require.NoError(t, store.Save(room))
+	require.NoError(t, store.Save(StoredRoom{Version: storeVersion, Room: Room{ID: "room2"}}))
+	rooms, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, rooms, 2)
+	assert.Equal(t, room.Room.Messages, rooms[0].Room.Messages)
+	assert.Equal(t, "a", rooms[0].OwnerID)
+
+	require.NoError(t, store.Delete("room2"))
+	require.NoError(t, store.Delete("room2"))
+	rooms, _ = store.Load()
+	assert.Len(t, rooms, 1)
+	assert.Error(t, store.Save(StoredRoom{Room: Room{ID: "../room"}}))
+}
+
+func TestFileStoreMigration(t *testing.T) {
+	dir, cleanup := tempDirT(t)
+	defer cleanup()
+	old := `{"version":1,"room":{"id":"old","owner":"a-peer","users":[],"messages":[{"author":"a","text":"hi","timestamp":"2020-05-01 10:00:00.5 +0300 MSK m=+0.01"}],"settings":{"topology":"mesh"}}}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "old.json"), []byte(old), 0600))
+	store, _ := NewFileStore(dir)
+
+	rooms, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, rooms, 1)
+	assert.Equal(t, storeVersion, rooms[0].Version)
+	assert.Equal(t, "old", rooms[0].Room.ID)
+	assert.Equal(t, TopologyMesh, rooms[0].Room.Settings.Topology)
+	assert.Equal(t, "hi", rooms[0].Room.Messages[0].Text)
+	assert.Equal(t, int64(1), rooms[0].Room.Messages[0].ID)
+	assert.Equal(t, int64(1), rooms[0].LastMessageID)
+	assert.Equal(t, "2020-05-01T07:00:00.5Z", rooms[0].Room.Messages[0].Timestamp)
+	assert.Equal(t, int64(1588316400500), rooms[0].Room.Messages[0].Time)
+	// migrated room is saved back
+	bts, _ := ioutil.ReadFile(filepath.Join(dir, "old.json"))
+	assert.Contains(t, string(bts), `"version":3`)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new.json"), []byte(`{"version":100}`), 0600))
+	_, err = store.Load()
+	assert.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new.json"), []byte(`{"id":"plain"}`), 0600))
+	_, err = store.Load()
+	assert.Error(t, err)
+}
+
+func TestRoomServiceRestore(t *testing.T) {
+	dir, cleanup := tempDirT(t)
+	defer cleanup()
+	store, _ := NewFileStore(dir)
+	rooms, err := NewRoomServiceWithStore(store)
+	require.NoError(t, err)
+	room, _ := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{Topology: TopologyMesh}, "secret")
+	rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer"}, "secret")
+	rooms.JoinToRoom(room.ID, User{ID: "b", PeerID: "b-peer"}, "secret")
+	rooms.AddMessage(room.ID, RoomMessage{Author: "a-peer", Text: "hi"})
+	rooms.AddDirectMessage(room.ID, RoomMessage{Author: "a-peer", Text: "secret", To: "owner"})
+	rooms.Ban(room.ID, "owner", "b-peer")
+	invite, _ := rooms.CreateInvite(room.ID, "owner", 1, roleViewer)
+	removed, _ := rooms.CreateRoom(User{ID: "c", PeerID: "c-peer"}, RoomSettings{}, "")
+	rooms.DeleteRoom(removed.ID, "c")
+	left, _ := rooms.CreateRoom(User{ID: "d", PeerID: "d-peer"}, RoomSettings{}, "")
+	rooms.LeaveRoom(left.ID, "d-peer")
+	rooms.Flush()
+
+	// restart
+	rooms, err = NewRoomServiceWithStore(store)
+	require.NoError(t, err)
+	assert.Nil(t, rooms.GetRoom(removed.ID))
+	// empty room waits for the owner
+	_, err = rooms.JoinToRoom(left.ID, User{ID: "d", PeerID: "d-peer2"}, "")
+	assert.NoError(t, err)
+	restored := rooms.GetRoom(room.ID)
+	require.NotNil(t, restored)
+	assert.Empty(t, restored.Users)
+	assert.Empty(t, restored.Owner)
+	assert.Equal(t, "hi", restored.Messages[0].Text)
+	assert.Equal(t, int64(1), restored.Messages[0].ID)
+	assert.Equal(t, []string{"b"}, restored.Banned)
+	assert.Equal(t, TopologyMesh, restored.Settings.Topology)
+
+	_, err = rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer2"}, "wrong")
+	assert.Equal(t, errWrongPassword, err)
+	// owner is back without password
+	restored, err = rooms.JoinToRoom(room.ID, User{ID: "owner", PeerID: "owner-peer2"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "owner-peer2", restored.Owner)
+	assert.Equal(t, roleOwner, peerRole(restored, "owner-peer2"))
+	restored, err = rooms.JoinWithInvite(room.ID, User{ID: "d", PeerID: "d-peer"}, invite)
+	require.NoError(t, err)
+	assert.Equal(t, roleViewer, peerRole(restored, "d-peer"))
+	// message ids continue after restart
+	restored, _ = rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer2", Text: "again"})
+	assert.Equal(t, int64(3), restored.Messages[1].ID)
+	direct, _, err := rooms.GetDirectMessages(room.ID, "owner", "a", 0, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, direct, 1)
+	assert.Equal(t, "secret", direct[0].Text)
+	_, err = rooms.JoinWithInvite(room.ID, User{ID: "e", PeerID: "e-peer"}, invite)
+	assert.Equal(t, errInvalidInvite, err)
+}
+
+// blockingStore counts saves and blocks them until it is released
+type blockingStore struct {
+	*MemoryStore
+	saves   chan StoredRoom
+	release chan struct{}
+}
+
+func (s *blockingStore) Save(room StoredRoom) error {
+	s.saves <- room
+	<-s.release
+	return s.MemoryStore.Save(room)
+}
+
+func TestRoomServiceSaveInBackground(t *testing.T) {
+	store := &blockingStore{MemoryStore: NewMemoryStore(), saves: make(chan StoredRoom, 10), release: make(chan struct{})}
+	rooms, err := NewRoomServiceWithStore(store)
+	require.NoError(t, err)
+	rooms.SaveDelay = 50 * time.Millisecond
+	room, _ := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{}, "")
+	rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "1"})
+	// burst of changes is written once
+	saved := <-store.saves
+	assert.Len(t, saved.Room.Messages, 1)
+
+	// the room is not locked while it is written
+	done := make(chan struct{})
+	go func() {
+		rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "2"})
+		rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "3"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("room is locked while it is saved")
+	}
+	close(store.release)
+	rooms.Flush()
+	saved = <-store.saves
+	assert.Len(t, saved.Room.Messages, 3)
+	assert.Empty(t, store.saves)
+
+	rooms.DeleteRoom(room.ID, "owner")
+	rooms.Flush()
+	stored, _ := store.Load()
+	assert.Empty(t, stored)
+}
@@ -3,10 +3,13 @@ package server
 import (
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/mikhail-angelov/websignal/auth"
+	"github.com/pkg/errors"
 )
 
 type contextKey string
@@ -14,18 +17,80 @@ type contextKey string
 //RoomsController controlles structure
 type RoomsController struct {
 	rooms *RoomService
+	auth  *auth.Auth
+	ws    *WsServer // notifies connected peers about changes
+}
+
+//InviteRequest is body of create invite request
+type InviteRequest struct {
+	TTL     int    `json:"ttl"`     // seconds, 0 means no expiration
+	MaxUses int    `json:"maxUses"` // 0 means unlimited
+	Role    string `json:"role,omitempty" validate:"oneof=moderator participant viewer"`
+}
+
+//InviteResponse is created invite
+type InviteResponse struct {
+	ID        string `json:"id"`
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expiresAt,omitempty"` // RFC3339
+}
+
+//ModerateRequest is body of kick, ban and mute requests
+type ModerateRequest struct {
+	PeerID string   `json:"peerId" validate:"required,max=64"`
+	Media  []string `json:"media,omitempty" validate:"max=3,oneof=audio video chat"` // mute only
+	Muted  bool     `json:"muted,omitempty"`                                         // mute only
+}
+
+//MessagesResponse is page of room messages
+type MessagesResponse struct {
+	Messages []RoomMessage `json:"messages"`
+	HasMore  bool          `json:"hasMore"` // there are more messages in the page direction
+}
+
+//RoomInfo is room rendered by REST api, chat history is requested by messages endpoint,
+//lobby and bans are sent to room managers by websocket only
+type RoomInfo struct {
+	ID        string       `json:"id"`
+	Owner     string       `json:"owner"`
+	Successor string       `json:"successor,omitempty"`
+	Users     []User       `json:"users"`
+	Settings  RoomSettings `json:"settings"`
+	Created   time.Time    `json:"created"`
+	Version   int64        `json:"version"`
+}
+
+const defaultMessagesPage = 50
+
+func roomInfo(room *Room) RoomInfo {
+	return RoomInfo{ID: room.ID, Owner: room.Owner, Successor: room.Successor, Users: room.Users,
+		Settings: room.Settings, Created: room.Created, Version: room.Version}
 }
 
 //NewRoomsController constructor
-func NewRoomsController(rooms *RoomService) *RoomsController {
+func NewRoomsController(rooms *RoomService, auth *auth.Auth, ws *WsServer) *RoomsController {
 	return &RoomsController{
 		rooms: rooms,
+		auth:  auth,
+		ws:    ws,
 	}
 }
 
 //HTTPHandler main handler
 func (c *RoomsController) HTTPHandler(r chi.Router) {
 	r.Get("/", c.getRooms)
+	r.Post("/", c.createRoom)
+	r.Get("/{id}", c.getRoom)
+	r.Put("/{id}/settings", c.updateSettings)
+	r.Delete("/{id}", c.deleteRoom)
+	r.Get("/{id}/messages", c.getMessages)
+	r.Get("/{id}/messages/{messageID}/thread", c.getThread)
+	r.Post("/{id}/invites", c.createInvite)
+	r.Delete("/{id}/invites/{inviteID}", c.revokeInvite)
+	r.Post("/{id}/kick", c.moderate(actionKick))
+	r.Post("/{id}/bans", c.moderate(actionBan))
+	r.Delete("/{id}/bans/{userID}", c.unban)
+	r.Post("/{id}/mute", c.moderate(actionMute))
 }
 
 func (c *RoomsController) getRooms(w http.ResponseWriter, r *http.Request) {
@@ -36,8 +101,294 @@ func (c *RoomsController) getRooms(w http.ResponseWriter, r *http.Request) {
 	rooms, err := c.rooms.GetUserRooms(user.ID)
 	if err != nil {
 		log.Printf("[WARN] cannot get rooms for %s", user.ID)
-		rooms = []Room{}
+	}
+	infos := []RoomInfo{}
+	for i := range rooms {
+		infos = append(infos, roomInfo(&rooms[i]))
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, infos)
+}
+
+// createRoom creates room owned by the user, the user becomes owner peer on join
+func (c *RoomsController) createRoom(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.GetUserInfo(r)
+	if err != nil {
+		renderError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	req := CreateRoomPayload{}
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := validatePayload(&req); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	room, err := c.rooms.CreateRoom(User{ID: user.ID, Name: user.Name}, req.Settings, req.Password)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, roomInfo(room))
+}
+
+func (c *RoomsController) getRoom(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.GetUserInfo(r)
+	if err != nil {
+		renderError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	room, err := c.rooms.GetRoomFor(chi.URLParam(r, "id"), user.ID)
+	if err != nil {
+		renderError(w, r, roomErrorStatus(err), err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, roomInfo(room))
+}
+
+// updateSettings replaces room settings, connected peers get the updated room
+func (c *RoomsController) updateSettings(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.GetUserInfo(r)
+	if err != nil {
+		renderError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	settings := RoomSettings{}
+	if err := render.DecodeJSON(r.Body, &settings); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := validatePayload(&settings); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	room, err := c.rooms.UpdateSettings(chi.URLParam(r, "id"), user.ID, settings)
+	if err != nil {
+		renderError(w, r, roomErrorStatus(err), err)
+		return
+	}
+	c.ws.notifyRoomUpdate(room, user.ID)
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, roomInfo(room))
+}
+
+// deleteRoom removes the room, connected peers are notified that it is closed
+func (c *RoomsController) deleteRoom(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.GetUserInfo(r)
+	if err != nil {
+		renderError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	room, err := c.rooms.DeleteRoom(chi.URLParam(r, "id"), user.ID)
+	if err != nil {
+		renderError(w, r, roomErrorStatus(err), err)
+		return
+	}
+	c.ws.notifyClosed(room, closedDeleted)
+	render.NoContent(w, r)
+}
+
+// getMessages returns page of chat history, the page is selected by before or after message id and limit,
+// direct messages with the other user are returned if with user id is set
+func (c *RoomsController) getMessages(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.GetUserInfo(r)
+	if err != nil {
+		renderError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	query := r.URL.Query()
+	params := map[string]int64{"before": 0, "after": 0, "limit": defaultMessagesPage}
+	for name := range params {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			renderError(w, r, http.StatusBadRequest, errors.Errorf("invalid %s %q", name, value))
+			return
+		}
+		params[name] = n
+	}
+	if params["before"] > 0 && params["after"] > 0 {
+		renderError(w, r, http.StatusBadRequest, errors.New("before and after cannot be used together"))
+		return
+	}
+	if params["limit"] == 0 || params["limit"] > maxMessagesPage {
+		renderError(w, r, http.StatusBadRequest, errors.Errorf("limit has to be from 1 to %d", maxMessagesPage))
+		return
+	}
+	roomID := chi.URLParam(r, "id")
+	var messages []RoomMessage
+	var hasMore bool
+	if with := query.Get("with"); with != "" {
+		messages, hasMore, err = c.rooms.GetDirectMessages(roomID, user.ID, with, params["before"], params["after"], int(params["limit"]))
+	} else {
+		messages, hasMore, err = c.rooms.GetMessages(roomID, user.ID, params["before"], params["after"], int(params["limit"]))
+	}
+	if err != nil {
+		renderError(w, r, roomErrorStatus(err), err)
+		return
 	}
 	render.Status(r, http.StatusOK)
-	render.JSON(w, r, rooms)
+	render.JSON(w, r, MessagesResponse{Messages: messages, HasMore: hasMore})
+}
+
+// getThread returns the thread of the message
+func (c *RoomsController) getThread(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.GetUserInfo(r)
+	if err != nil {
+		renderError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "messageID"), 10, 64)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, errors.Errorf("invalid message id %q", chi.URLParam(r, "messageID")))
+		return
+	}
+	thread, err := c.rooms.GetThread(chi.URLParam(r, "id"), user.ID, id)
+	if err != nil {
+		renderError(w, r, roomErrorStatus(err), err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, MessagesResponse{Messages: thread})
+}
+
+func (c *RoomsController) createInvite(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.GetUserInfo(r)
+	if err != nil {
+		renderError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	req := InviteRequest{}
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := validatePayload(&req); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.TTL < 0 || req.MaxUses < 0 {
+		renderError(w, r, http.StatusBadRequest, errors.New("ttl and maxUses cannot be negative"))
+		return
+	}
+	invite, err := c.rooms.CreateInvite(chi.URLParam(r, "id"), user.ID, req.MaxUses, req.Role)
+	if err != nil {
+		renderError(w, r, roomErrorStatus(err), err)
+		return
+	}
+	ttl := time.Duration(req.TTL) * time.Second
+	token, err := c.auth.InviteToken(invite, ttl)
+	if err != nil {
+		log.Printf("[WARN] cannot sign invite %s, %v", invite.ID, err)
+		c.rooms.RevokeInvite(invite.RoomID, user.ID, invite.ID)
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	res := InviteResponse{ID: invite.ID, Token: token}
+	if ttl > 0 {
+		res.ExpiresAt = time.Now().Add(ttl).Format(time.RFC3339)
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, res)
+}
+
+func (c *RoomsController) revokeInvite(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.GetUserInfo(r)
+	if err != nil {
+		renderError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	if err := c.rooms.RevokeInvite(chi.URLParam(r, "id"), user.ID, chi.URLParam(r, "inviteID")); err != nil {
+		renderError(w, r, roomErrorStatus(err), err)
+		return
+	}
+	render.NoContent(w, r)
+}
+
+// moderate returns handler of kick, ban or mute request
+func (c *RoomsController) moderate(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth.GetUserInfo(r)
+		if err != nil {
+			renderError(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		req := ModerateRequest{}
+		if err := render.DecodeJSON(r.Body, &req); err != nil {
+			renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := validatePayload(&req); err != nil {
+			renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		roomID := chi.URLParam(r, "id")
+		event := ModerationPayload{RoomID: roomID, Action: action, By: user.ID, PeerID: req.PeerID}
+		var room *Room
+		switch action {
+		case actionKick:
+			room, err = c.rooms.Kick(roomID, user.ID, req.PeerID)
+		case actionBan:
+			room, event.UserID, err = c.rooms.Ban(roomID, user.ID, req.PeerID)
+		case actionMute:
+			if len(req.Media) == 0 {
+				renderError(w, r, http.StatusBadRequest, errors.New("media is required"))
+				return
+			}
+			event.Media = req.Media
+			if !req.Muted {
+				event.Action = actionUnmute
+			}
+			room, err = c.rooms.Mute(roomID, user.ID, req.PeerID, req.Media, req.Muted)
+		}
+		if err != nil {
+			renderError(w, r, roomErrorStatus(err), err)
+			return
+		}
+		c.ws.notifyModeration(room, event)
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, roomInfo(room))
+	}
+}
+
+func (c *RoomsController) unban(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.GetUserInfo(r)
+	if err != nil {
+		renderError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	room, err := c.rooms.Unban(chi.URLParam(r, "id"), user.ID, chi.URLParam(r, "userID"))
+	if err != nil {
+		renderError(w, r, roomErrorStatus(err), err)
+		return
+	}
+	c.ws.notifyModeration(room, ModerationPayload{RoomID: room.ID, Action: actionUnban, By: user.ID, UserID: chi.URLParam(r, "userID")})
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, roomInfo(room))
+}
+
+// roomErrorStatus converts room service error to http status
+func roomErrorStatus(err error) int {
+	if _, ok := err.(notOwnerError); ok {
+		return http.StatusForbidden
+	}
+	switch errors.Cause(err) {
+	case errRoomNotFound, errInvalidInvite, errNotMember, errMessageNotFound:
+		return http.StatusNotFound
+	case errForbidden:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func renderError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	render.Status(r, status)
+	render.JSON(w, r, ErrorResponse{Error: err.Error()})
 }
@@ -6,10 +6,12 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/go-chi/chi"
 	"github.com/mikhail-angelov/websignal/auth"
+	"github.com/mikhail-angelov/websignal/logger"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -24,8 +26,11 @@ func fakeAuth(next http.Handler) http.Handler {
 func startupT(t *testing.T) (ts *httptest.Server, rs *RoomService, teardown func()) {
 
 	rooms := NewRoomService()
-	controller := NewRoomsController(rooms)
+	auth1 := auth.NewAuth(testSecret, logger.New(), "test-url")
+	ws := NewWsServer(rooms, auth1, logger.New())
+	controller := NewRoomsController(rooms, auth1, ws)
 	router := chi.NewRouter()
+	router.HandleFunc("/ws", ws.SocketHandler)
 	router.Route("/api", func(rapi chi.Router) {
 		rapi.Group(func(r chi.Router) {
 			r.Use(fakeAuth)
@@ -60,3 +65,244 @@ func TestGetRoomsAPI(t *testing.T) {
 	assert.Equal(t, 0, len(response))
 	log.Printf("[INFO] rooms: %v ", response)
 }
+
+func TestGetUserRoomsAPI(t *testing.T) {
+	ts, rooms, teardown := startupT(t)
+	defer teardown()
+
+	own, _ := rooms.CreateRoom(User{ID: "test", PeerID: "test-laptop"}, RoomSettings{}, "")
+	other, _ := rooms.CreateRoom(User{ID: "other", PeerID: "other-peer"}, RoomSettings{}, "")
+	rooms.JoinToRoom(other.ID, User{ID: "test", PeerID: "test-phone"}, "")
+	rooms.CreateRoom(User{ID: "other", PeerID: "other-peer2"}, RoomSettings{}, "")
+
+	status, body := requestT(t, "GET", ts.URL+"/api/room", "")
+	require.Equal(t, http.StatusOK, status)
+	response := []Room{}
+	require.Nil(t, json.Unmarshal(body, &response))
+	ids := []string{}
+	for _, room := range response {
+		ids = append(ids, room.ID)
+	}
+	assert.ElementsMatch(t, []string{own.ID, other.ID}, ids)
+
+	rooms.LeaveRoom(other.ID, "test-phone")
+	status, body = requestT(t, "GET", ts.URL+"/api/room", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Nil(t, json.Unmarshal(body, &response))
+	require.Len(t, response, 1)
+	assert.Equal(t, own.ID, response[0].ID)
+}
+
+func requestT(t *testing.T, method, url string, body string) (int, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	bts, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	return resp.StatusCode, bts
+}
+
+func TestInviteAPI(t *testing.T) {
+	ts, rooms, teardown := startupT(t)
+	defer teardown()
+
+	room, _ := rooms.CreateRoom(User{ID: "test", PeerID: "test-peer"}, RoomSettings{Private: true}, "")
+	other, _ := rooms.CreateRoom(User{ID: "other", PeerID: "other-peer"}, RoomSettings{Private: true}, "")
+
+	status, body := requestT(t, "POST", ts.URL+"/api/room/"+room.ID+"/invites", `{"ttl":60,"maxUses":1,"role":"viewer"}`)
+	require.Equal(t, http.StatusCreated, status, string(body))
+	res := InviteResponse{}
+	require.Nil(t, json.Unmarshal(body, &res))
+	assert.NotEmpty(t, res.ExpiresAt)
+	invite, err := auth.NewAuth(testSecret, logger.New(), "test-url").ParseInvite(res.Token)
+	require.Nil(t, err)
+	assert.Equal(t, auth.Invite{ID: res.ID, RoomID: room.ID, MaxUses: 1, Role: "viewer"}, *invite)
+
+	status, _ = requestT(t, "POST", ts.URL+"/api/room/"+other.ID+"/invites", `{}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = requestT(t, "POST", ts.URL+"/api/room/none/invites", `{}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = requestT(t, "POST", ts.URL+"/api/room/"+room.ID+"/invites", `{"role":"owner"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = requestT(t, "POST", ts.URL+"/api/room/"+room.ID+"/invites", `{"maxUses":-1}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = requestT(t, "DELETE", ts.URL+"/api/room/"+room.ID+"/invites/"+res.ID, "")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = requestT(t, "DELETE", ts.URL+"/api/room/"+room.ID+"/invites/"+res.ID, "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// owner of the room created by REST invites before joining it
+	status, body = requestT(t, "POST", ts.URL+"/api/room", `{"settings":{"private":true}}`)
+	require.Equal(t, http.StatusCreated, status, string(body))
+	created := RoomInfo{}
+	require.Nil(t, json.Unmarshal(body, &created))
+	status, body = requestT(t, "POST", ts.URL+"/api/room/"+created.ID+"/invites", `{}`)
+	require.Equal(t, http.StatusCreated, status, string(body))
+	require.Nil(t, json.Unmarshal(body, &res))
+	status, _ = requestT(t, "DELETE", ts.URL+"/api/room/"+created.ID+"/invites/"+res.ID, "")
+	assert.Equal(t, http.StatusNoContent, status)
+}
+
+func TestModerationAPI(t *testing.T) {
+	ts, rooms, teardown := startupT(t)
+	defer teardown()
+
+	room, _ := rooms.CreateRoom(User{ID: "test", PeerID: "test-peer"}, RoomSettings{}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer"}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "b", PeerID: "b-peer"}, "")
+	other, _ := rooms.CreateRoom(User{ID: "other", PeerID: "other-peer"}, RoomSettings{}, "")
+	rooms.JoinToRoom(other.ID, User{ID: "a", PeerID: "a-other"}, "")
+
+	status, _ := requestT(t, "POST", ts.URL+"/api/room/"+other.ID+"/kick", `{"peerId":"a-other"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = requestT(t, "POST", ts.URL+"/api/room/"+room.ID+"/kick", `{"peerId":"none"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = requestT(t, "POST", ts.URL+"/api/room/"+room.ID+"/kick", `{}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, body := requestT(t, "POST", ts.URL+"/api/room/"+room.ID+"/kick", `{"peerId":"a-peer"}`)
+	require.Equal(t, http.StatusOK, status, string(body))
+	assert.False(t, hasUser(rooms.GetRoom(room.ID).Users, "a-peer"))
+
+	status, _ = requestT(t, "POST", ts.URL+"/api/room/"+room.ID+"/mute", `{"peerId":"b-peer"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = requestT(t, "POST", ts.URL+"/api/room/"+room.ID+"/mute", `{"peerId":"b-peer","media":["video"],"muted":true}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"video"}, rooms.GetRoom(room.ID).Users[1].Muted)
+
+	// banned peer has no connection, its user is taken from the room
+	owner := dialWsT(t, ts, "test", "test-peer")
+	defer owner.Close()
+	status, _ = requestT(t, "POST", ts.URL+"/api/room/"+room.ID+"/bans", `{"peerId":"b-peer"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"b"}, rooms.GetRoom(room.ID).Banned)
+	event := readTypeWsT(t, owner, moderationMessage)
+	assert.Equal(t, actionBan, event["action"])
+	assert.Equal(t, "b", event["userId"])
+	status, _ = requestT(t, "DELETE", ts.URL+"/api/room/"+room.ID+"/bans/b", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, rooms.GetRoom(room.ID).Banned)
+	status, _ = requestT(t, "DELETE", ts.URL+"/api/room/"+room.ID+"/bans/b", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestMessagesAPI(t *testing.T) {
+	ts, rooms, teardown := startupT(t)
+	defer teardown()
+
+	room, _ := rooms.CreateRoom(User{ID: "test", PeerID: "test-peer"}, RoomSettings{}, "")
+	other, _ := rooms.CreateRoom(User{ID: "other", PeerID: "other-peer"}, RoomSettings{}, "")
+	for i := 0; i < 5; i++ {
+		rooms.AddMessage(room.ID, RoomMessage{Author: "test-peer", Text: "hi"})
+	}
+
+	status, body := requestT(t, "GET", ts.URL+"/api/room/"+room.ID+"/messages?before=5&limit=2", "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	res := MessagesResponse{}
+	require.Nil(t, json.Unmarshal(body, &res))
+	assert.True(t, res.HasMore)
+	require.Len(t, res.Messages, 2)
+	assert.Equal(t, int64(3), res.Messages[0].ID)
+	status, body = requestT(t, "GET", ts.URL+"/api/room/"+room.ID+"/messages?after=3", "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	res = MessagesResponse{}
+	require.Nil(t, json.Unmarshal(body, &res))
+	assert.False(t, res.HasMore)
+	assert.Len(t, res.Messages, 2)
+
+	rooms.AddMessage(room.ID, RoomMessage{Author: "test-peer", Text: "reply", ReplyTo: 2})
+	status, body = requestT(t, "GET", ts.URL+"/api/room/"+room.ID+"/messages/2/thread", "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	res = MessagesResponse{}
+	require.Nil(t, json.Unmarshal(body, &res))
+	require.Len(t, res.Messages, 2)
+	assert.Equal(t, int64(2), res.Messages[1].ReplyTo)
+	status, _ = requestT(t, "GET", ts.URL+"/api/room/"+room.ID+"/messages/100/thread", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = requestT(t, "GET", ts.URL+"/api/room/"+room.ID+"/messages/x/thread", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	rooms.JoinToRoom(room.ID, User{ID: "a", PeerID: "a-peer"}, "")
+	rooms.AddDirectMessage(room.ID, RoomMessage{Author: "a-peer", Text: "secret", To: "test"})
+	status, body = requestT(t, "GET", ts.URL+"/api/room/"+room.ID+"/messages?with=a", "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	res = MessagesResponse{}
+	require.Nil(t, json.Unmarshal(body, &res))
+	require.Len(t, res.Messages, 1)
+	assert.Equal(t, "secret", res.Messages[0].Text)
+
+	status, _ = requestT(t, "GET", ts.URL+"/api/room/"+other.ID+"/messages", "")
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = requestT(t, "GET", ts.URL+"/api/room/none/messages", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = requestT(t, "GET", ts.URL+"/api/room/"+room.ID+"/messages?limit=1000", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = requestT(t, "GET", ts.URL+"/api/room/"+room.ID+"/messages?before=x", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = requestT(t, "GET", ts.URL+"/api/room/"+room.ID+"/messages?before=2&after=1", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestRoomCRUDAPI(t *testing.T) {
+	ts, rooms, teardown := startupT(t)
+	defer teardown()
+
+	status, body := requestT(t, "POST", ts.URL+"/api/room", `{"settings":{"name":"daily","topic":"sync","topology":"mesh"},"password":"secret"}`)
+	require.Equal(t, http.StatusCreated, status, string(body))
+	room := Room{}
+	require.Nil(t, json.Unmarshal(body, &room))
+	assert.Equal(t, "daily", room.Settings.Name)
+	assert.True(t, room.Settings.Protected)
+	assert.Empty(t, room.Users)
+	assert.False(t, room.Created.IsZero())
+	status, _ = requestT(t, "POST", ts.URL+"/api/room", `{"settings":{"topology":"ring"}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// creator becomes owner on join
+	owner := dialWsT(t, ts, "test", "test-peer")
+	defer owner.Close()
+	joined, err := rooms.JoinToRoom(room.ID, User{ID: "test", PeerID: "test-peer"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "test-peer", joined.Owner)
+
+	_, err = rooms.AddMessage(room.ID, RoomMessage{Author: "test-peer", Text: "secret"})
+	require.NoError(t, err)
+	status, body = requestT(t, "GET", ts.URL+"/api/room/"+room.ID, "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	// history is requested by members from messages endpoint
+	info := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(body, &info))
+	assert.Equal(t, room.ID, info["id"])
+	assert.NotContains(t, info, "messages")
+	assert.NotContains(t, info, "pending")
+	assert.NotContains(t, info, "banned")
+	status, _ = requestT(t, "GET", ts.URL+"/api/room/none", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	private, _ := rooms.CreateRoom(User{ID: "other", PeerID: "other-peer"}, RoomSettings{Private: true}, "")
+	status, _ = requestT(t, "GET", ts.URL+"/api/room/"+private.ID, "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, body = requestT(t, "PUT", ts.URL+"/api/room/"+room.ID+"/settings", `{"name":"weekly","topology":"star"}`)
+	require.Equal(t, http.StatusOK, status, string(body))
+	update := Room{}
+	require.Nil(t, json.Unmarshal(nextTypeWsT(t, owner, roomUpdateMessage).Data, &update))
+	assert.Equal(t, "weekly", update.Settings.Name)
+	assert.Equal(t, TopologyStar, update.Settings.Topology)
+	assert.True(t, update.Settings.Protected)
+	status, _ = requestT(t, "PUT", ts.URL+"/api/room/"+private.ID+"/settings", `{"name":"mine"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _ = requestT(t, "DELETE", ts.URL+"/api/room/"+private.ID, "")
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = requestT(t, "DELETE", ts.URL+"/api/room/"+room.ID, "")
+	assert.Equal(t, http.StatusNoContent, status)
+	closed := RoomClosedPayload{}
+	require.Nil(t, json.Unmarshal(nextTypeWsT(t, owner, roomClosedMessage).Data, &closed))
+	assert.Equal(t, RoomClosedPayload{RoomID: room.ID, Reason: closedDeleted}, closed)
+	assert.Nil(t, rooms.GetRoom(room.ID))
+	status, _ = requestT(t, "DELETE", ts.URL+"/api/room/"+room.ID, "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -14,33 +16,44 @@ import (
 	"github.com/mikhail-angelov/websignal/logger"
 )
 
-// Server is http server
+// Server is http server,
+// rooms of DataDir have no peers after restart, so they are closed after RoomIdleTTL unless their users are back
 type Server struct {
-	Port string
+	Port            string
+	DataDir         string        // rooms are kept in the directory between restarts, they are kept in memory if it is empty
+	RoomIdleTTL     time.Duration // idle rooms are closed after it, 0 keeps the default, negative disables it
+	RoomMaxLifetime time.Duration // rooms are closed after it, 0 means unlimited
 }
 
+const shutdownTimeout = 10 * time.Second
+
 func test(w http.ResponseWriter, r *http.Request) {
 	render.Status(r, http.StatusOK)
 	render.PlainText(w, r, "test"+time.Now().String())
 }
 
-func (s *Server) composeRouter(jwtSectret string) *chi.Mux {
+func (s *Server) composeRouter(jwtSectret string) (*chi.Mux, *WsServer) {
 	var (
 		url             = "http://localhost:9001"
 		logger          = logger.New()
+		avatars         = auth.NewAvatars(s.avatarsDir())
 		auth            = auth.NewAuth(jwtSectret, logger, url)
-		rooms           = NewRoomService()
+		rooms           = s.newRoomService()
 		ws              = NewWsServer(rooms, auth, logger)
-		roomsController = NewRoomsController(rooms)
+		roomsController = NewRoomsController(rooms, auth, ws)
 		router          = chi.NewRouter()
 	)
+	auth.Avatars = avatars
 	auth.AddProvider("yandex", os.Getenv("YANDEX_OAUTH2_ID"), os.Getenv("YANDEX_OAUTH2_SECRET"))
 	auth.AddProvider("github", os.Getenv("GITHUB_OAUTH2_ID"), os.Getenv("GITHUB_OAUTH2_SECRET"))
 	auth.AddProvider("google", os.Getenv("GOOGLE_OAUTH2_ID"), os.Getenv("GOOGLE_OAUTH2_SECRET"))
 	auth.AddProvider("local", "test", "test")
 	AddFileServer(router, "/", http.Dir("./static"))
 	router.HandleFunc("/ws", ws.SocketHandler)
+	router.With(auth.Auth).Get("/ws/stats", ws.StatsHandler) // traffic counters are not public
+	router.Get("/ws/protocol", ws.ProtocolHandler)
 	router.Mount("/auth", auth.Handlers())
+	router.Get(avatars.Path+"/{userID}", avatars.ServeHTTP)
 	router.Route("/api", func(rapi chi.Router) {
 		rapi.Group(func(r chi.Router) {
 			r.Use(auth.Auth)
@@ -49,32 +62,69 @@ func (s *Server) composeRouter(jwtSectret string) *chi.Mux {
 	})
 	router.HandleFunc("/test", test)
 
-	return router
+	return router, ws
+}
+
+// avatarsDir returns directory of rendered avatars, they are kept in memory without data directory
+func (s *Server) avatarsDir() string {
+	if s.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(s.DataDir, "avatars")
+}
+
+func (s *Server) newRoomService() *RoomService {
+	rooms := NewRoomService()
+	if s.DataDir != "" {
+		store, err := NewFileStore(s.DataDir)
+		if err != nil {
+			log.Fatalf("[ERROR] room store error: %v", err)
+		}
+		rooms, err = NewRoomServiceWithStore(store)
+		if err != nil {
+			log.Fatalf("[ERROR] room store error: %v", err)
+		}
+	}
+	if s.RoomIdleTTL != 0 {
+		rooms.IdleTTL = s.RoomIdleTTL
+	}
+	if rooms.IdleTTL < 0 {
+		rooms.IdleTTL = 0
+	}
+	rooms.MaxLifetime = s.RoomMaxLifetime
+	return rooms
 }
 
 // Run the HTTP server
 func (s *Server) Run(jwtSectret string) error {
 	var (
-		serve  = make(chan error, 1)
-		sig    = make(chan os.Signal, 1)
-		router = s.composeRouter(jwtSectret)
+		serve      = make(chan error, 1)
+		sig        = make(chan os.Signal, 1)
+		router, ws = s.composeRouter(jwtSectret)
 	)
+	// reaper is stopped on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ws.Reap(ctx, defaultReapInterval)
 
 	port := s.Port
 	log.Printf("listen %s port", port)
-	err := http.ListenAndServe(":"+port, router)
-	if err != nil {
-		log.Fatalf("listen %s error: %v", port, err)
-		return err
-	}
-	signal.Notify(sig, syscall.SIGTERM)
+	srv := &http.Server{Addr: ":" + port, Handler: router}
+	go func() { serve <- srv.ListenAndServe() }()
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
 
+	var err error
 	select {
-	case err := <-serve:
-		log.Fatal(err)
+	case err = <-serve:
+		log.Printf("[ERROR] listen %s error: %v", port, err)
 	case sig := <-sig:
 		log.Printf("signal %q received", sig)
+		cancel()
+		shutdown, done := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer done()
+		err = srv.Shutdown(shutdown)
 	}
+	ws.rooms.Flush()
 	log.Printf("[INFO] signaling server is terminated with error %+v", err)
 	return err
 }
@@ -0,0 +1,93 @@
+package server
+
+import "sort"
+
+// Topology of peer connections in the room
+type Topology string
+
+// room topologies
+const (
+	TopologyMesh Topology = "mesh" // every peer is connected to every other peer
+	TopologyStar Topology = "star" // every peer is connected to the hub, the room owner
+	TopologyAuto Topology = "auto" // mesh for small rooms, star for large ones
+)
+
+const defaultMeshLimit = 4
+
+// PeerLink is a peer connection planned by server, From peer initiates the connection
+type PeerLink struct {
+	From string
+	To   string
+}
+
+// linkKey identifies connection regardless of its direction
+type linkKey struct {
+	a, b string
+}
+
+func (l PeerLink) key() linkKey {
+	if l.From < l.To {
+		return linkKey{l.From, l.To}
+	}
+	return linkKey{l.To, l.From}
+}
+
+// planLinks returns peer connections required by the topology,
+// peers are ordered by join time and the later peer initiates the connection
+func planLinks(topology Topology, peers []string, hub string, meshLimit int) map[linkKey]PeerLink {
+	if topology == TopologyAuto {
+		topology = TopologyStar
+		if len(peers) <= meshLimit {
+			topology = TopologyMesh
+		}
+	}
+	if topology == TopologyStar && !contains(peers, hub) && len(peers) > 0 {
+		hub = peers[0]
+	}
+	links := map[linkKey]PeerLink{}
+	for i, peer := range peers {
+		for _, earlier := range peers[:i] {
+			if topology == TopologyMesh || peer == hub || earlier == hub {
+				link := PeerLink{From: peer, To: earlier}
+				links[link.key()] = link
+			}
+		}
+	}
+	return links
+}
+
+// diffLinks returns links to open and links to close to move from current to planned connections
+func diffLinks(current, planned map[linkKey]PeerLink) (open []PeerLink, closed []PeerLink) {
+	open, closed = []PeerLink{}, []PeerLink{}
+	for k, link := range planned {
+		if _, ok := current[k]; !ok {
+			open = append(open, link)
+		}
+	}
+	for k, link := range current {
+		if _, ok := planned[k]; !ok {
+			closed = append(closed, link)
+		}
+	}
+	sortLinks(open)
+	sortLinks(closed)
+	return open, closed
+}
+
+func sortLinks(links []PeerLink) {
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].From != links[j].From {
+			return links[i].From < links[j].From
+		}
+		return links[i].To < links[j].To
+	})
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
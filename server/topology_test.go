@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func linksOf(links map[linkKey]PeerLink) []PeerLink {
+	list := []PeerLink{}
+	for _, l := range links {
+		list = append(list, l)
+	}
+	sortLinks(list)
+	return list
+}
+
+func TestPlanLinks(t *testing.T) {
+	peers := []string{"a", "b", "c"}
+	mesh := linksOf(planLinks(TopologyMesh, peers, "a", defaultMeshLimit))
+	assert.Equal(t, []PeerLink{{"b", "a"}, {"c", "a"}, {"c", "b"}}, mesh)
+
+	star := linksOf(planLinks(TopologyStar, peers, "b", defaultMeshLimit))
+	assert.Equal(t, []PeerLink{{"b", "a"}, {"c", "b"}}, star)
+
+	// hub is gone, the longest present peer is used
+	star = linksOf(planLinks(TopologyStar, []string{"b", "c"}, "a", defaultMeshLimit))
+	assert.Equal(t, []PeerLink{{"c", "b"}}, star)
+
+	auto := linksOf(planLinks(TopologyAuto, peers, "a", 3))
+	assert.Equal(t, mesh, auto)
+	auto = linksOf(planLinks(TopologyAuto, peers, "a", 2))
+	assert.Equal(t, []PeerLink{{"b", "a"}, {"c", "a"}}, auto)
+}
+
+func TestDiffLinks(t *testing.T) {
+	current := planLinks(TopologyMesh, []string{"a", "b", "c"}, "a", defaultMeshLimit)
+	planned := planLinks(TopologyStar, []string{"a", "b", "c", "d"}, "a", defaultMeshLimit)
+	open, closed := diffLinks(current, planned)
+	assert.Equal(t, []PeerLink{{"d", "a"}}, open)
+	assert.Equal(t, []PeerLink{{"c", "b"}}, closed)
+
+	// direction does not matter
+	current = map[linkKey]PeerLink{}
+	link := PeerLink{From: "a", To: "b"}
+	current[link.key()] = link
+	open, closed = diffLinks(current, planLinks(TopologyMesh, []string{"a", "b"}, "a", defaultMeshLimit))
+	assert.Empty(t, open)
+	assert.Empty(t, closed)
+}
+
+func TestReplan(t *testing.T) {
+	rooms := NewRoomService()
+	rooms.MeshLimit = 2
+	room, err := rooms.CreateRoom(User{ID: "a", PeerID: "a"}, RoomSettings{}, "")
+	require.NoError(t, err)
+	assert.Equal(t, TopologyAuto, room.Settings.Topology)
+	open, closed, err := rooms.Replan(room.ID)
+	require.NoError(t, err)
+	assert.Empty(t, open)
+	assert.Empty(t, closed)
+
+	rooms.JoinToRoom(room.ID, User{ID: "b", PeerID: "b"}, "")
+	rooms.AddFakeUser(room.ID, "a", &User{ID: "fake"})
+	open, closed, _ = rooms.Replan(room.ID)
+	assert.Equal(t, []PeerLink{{"b", "a"}}, open)
+	assert.Empty(t, closed)
+
+	// mesh limit is reached, the room is switched to star
+	rooms.JoinToRoom(room.ID, User{ID: "c", PeerID: "c"}, "")
+	open, closed, _ = rooms.Replan(room.ID)
+	assert.Equal(t, []PeerLink{{"c", "a"}}, open)
+	assert.Empty(t, closed)
+
+	// hub leaves, peers are connected to the next one
+	rooms.LeaveRoom(room.ID, "a")
+	open, closed, _ = rooms.Replan(room.ID)
+	assert.Equal(t, []PeerLink{{"c", "b"}}, open)
+	assert.Equal(t, []PeerLink{{"b", "a"}, {"c", "a"}}, closed)
+
+	_, _, err = rooms.Replan("none")
+	assert.Equal(t, errRoomNotFound, err)
+}
@@ -3,40 +3,77 @@ package server
 import (
 	"encoding/json"
 	"log"
-	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-chi/render"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
 	"github.com/mikhail-angelov/websignal/auth"
 	"github.com/mikhail-angelov/websignal/logger"
 	"github.com/pkg/errors"
 )
 
-// WS is websocket connection
-type WS struct {
-	Conn net.Conn
-	ID   string
-}
+const (
+	defaultSendQueueSize = 64
+	defaultWriteTimeout  = 10 * time.Second
+	defaultPingInterval  = 20 * time.Second
+	defaultIdleTimeout   = 60 * time.Second
+	defaultResumeGrace   = 30 * time.Second
+	defaultMaxMessage    = 64 * 1024
+)
+
+var errPeerNotFound = errors.New("peer is not connected")
 
 // WsServer is websocket server
+// settings have to be changed before the server starts to accept connections
 type WsServer struct {
-	clients map[string]*WS
-	rooms   *RoomService
-	auth    *auth.Auth
-	log     *logger.Log
+	SendQueueSize  int             // outbound messages buffered per connection
+	WriteTimeout   time.Duration   // deadline for a single socket write
+	OverflowPolicy OverflowPolicy  // what to do with a peer whose queue is full
+	PingInterval   time.Duration   // how often server pings the peer
+	IdleTimeout    time.Duration   // connection is closed if nothing (pong as well) is received from the peer during it
+	ResumeGrace    time.Duration   // how long disconnected peer keeps its rooms and can resume the session
+	DuplicateIDs   DuplicatePolicy // what to do when the socket id is connected already
+	GenerateIDs    bool            // socket ids are generated by server, client id is accepted only to resume the session
+	MaxMessageSize int64           // larger messages from peers are rejected
+	EventRate      float64         // ephemeral events per second allowed to a peer, 0 disables the limit
+	EventBurst     int             // ephemeral events a peer may send at once
+
+	stats     WsStats
+	mu        sync.RWMutex // guards clients, sessions and userPeers
+	clients   map[string]*WS
+	sessions  map[string]*session
+	userPeers map[string]map[string]bool // user id to socket ids of its sessions
+	rooms     *RoomService
+	auth      *auth.Auth
+	log       *logger.Log
 }
 
 //NewWsServer create new service
 func NewWsServer(rooms *RoomService, auth *auth.Auth, log *logger.Log) *WsServer {
-	res := WsServer{
-		clients: make(map[string]*WS),
-		rooms:   rooms,
-		auth:    auth,
-		log:     log,
+	s := &WsServer{
+		SendQueueSize:  defaultSendQueueSize,
+		WriteTimeout:   defaultWriteTimeout,
+		OverflowPolicy: DisconnectOnOverflow,
+		PingInterval:   defaultPingInterval,
+		IdleTimeout:    defaultIdleTimeout,
+		ResumeGrace:    defaultResumeGrace,
+		MaxMessageSize: defaultMaxMessage,
+		EventRate:      defaultEventRate,
+		EventBurst:     defaultEventBurst,
+		clients:        make(map[string]*WS),
+		sessions:       make(map[string]*session),
+		userPeers:      make(map[string]map[string]bool),
+		rooms:          rooms,
+		auth:           auth,
+		log:            log,
 	}
-	return &res
+	rooms.publisher = s.publishChanges
+	return s
 }
 
 // SocketHandler process ws messages
@@ -50,145 +87,429 @@ func (s *WsServer) SocketHandler(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
 	socketID := r.URL.Query().Get("id")
 	authUser, err := s.auth.ValidateToken(token)
-	id := authUser.ID
-	if err != nil || id == "" || socketID == "" {
-		s.log.Logf("[WARN] connection auth error:  %s, %s, %s", id, socketID, err)
+	if err != nil || authUser == nil || authUser.ID == "" || (socketID == "" && !s.GenerateIDs) {
+		s.log.Logf("[WARN] connection auth error:  %s, %v", socketID, err)
 		return
 	}
 	// continue connection after validation
-	defer delete(s.clients, socketID)
-	// todo: check id is used
-	client := &WS{Conn: conn, ID: id}
-	s.clients[socketID] = client
-	s.log.Logf("[INFO] connected: %s", id)
-	user := User{ID: authUser.ID, PeerID: socketID, Name: authUser.Name, Picture: authUser.Picture, PictureURL: authUser.PictureURL}
+	id := authUser.ID
+	client := newWS(conn, id, s.SendQueueSize)
+	go client.writeLoop(s.WriteTimeout, s.PingInterval, &s.stats)
+	defer client.close()
+	user := User{ID: authUser.ID, PeerID: socketID, Name: authUser.Name, PictureURL: authUser.PictureURL}
+	sess, resumed, err := s.attach(user, client, r.URL.Query().Get("resume"))
+	if err != nil {
+		s.log.Logf("[WARN] connection is refused %s, %s: %v", id, socketID, err)
+		if e, ok := err.(closeError); ok {
+			client.closeWith(e.code, e.reason, s.WriteTimeout)
+		}
+		return
+	}
+	user = sess.user
+	socketID = sess.id
+	s.log.Logf("[INFO] connected: %s, %s, resumed: %v", id, socketID, resumed)
 
 	for {
-		bts, _, err := wsutil.ReadClientData(conn)
-		if err != nil {
+		bts, err := client.read(s.IdleTimeout, s.WriteTimeout, s.MaxMessageSize)
+		if err != nil && err != errMessageTooLarge {
 			s.log.Logf("[WARN] read message error:  %v", err)
-			s.onCloseConnection(user)
+			s.detach(sess, client)
 			return
 		}
+		if err == errMessageTooLarge {
+			s.sendError(socketID, &Message{}, newProtocolError(codeTooLarge, "message is larger than %d bytes", s.MaxMessageSize))
+			continue
+		}
 		s.processMessage(client, socketID, user, bts)
 	}
 }
 
+// processMessage handles message from the peer, the peer gets error message if it fails
+// or acknowledgement if the message has request id
 func (s *WsServer) processMessage(from *WS, socketID string, user User, bts []byte) error {
-	var err error
 	message := Message{}
-	//log.Printf("Message: %s", string(bts))
-	json.Unmarshal(bts, &message)
-	messageData := InputMessageData{}
-	json.Unmarshal(message.Data, &messageData)
-
+	if err := json.Unmarshal(bts, &message); err != nil {
+		err = newProtocolError(codeBadMessage, "invalid message: %v", err)
+		s.sendError(socketID, &message, err)
+		return err
+	}
 	log.Printf("receive %d from %s to %s", message.Type, socketID, message.To)
+	err := validatePayload(&message)
+	if err == nil {
+		err = s.authorize(user, &message)
+	}
+	if err == nil {
+		err = s.handleMessage(from, socketID, user, &message)
+	}
+	if err != nil {
+		s.sendError(socketID, &message, err)
+		return err
+	}
+	if message.RequestID != "" {
+		data := composeData(AckPayload{Type: message.Type})
+		s.send(socketID, &Message{From: socketID, Type: ackMessage, RequestID: message.RequestID, Data: data, To: socketID})
+	}
+	return nil
+}
+
+// roomTarget is room of the message, fake user messages name it roomId and id is fake user id there
+type roomTarget struct {
+	ID     string `json:"id"`
+	RoomID string `json:"roomId"`
+}
+
+// authorize checks that the user has the role required by messageRoles in the room of the message,
+// missing room and membership are reported by the message handler, services check their own rules as well,
+// sdp is peer to peer, it is checked by CanPublish
+func (s *WsServer) authorize(user User, message *Message) error {
+	required, ok := messageRoles[message.Type]
+	if !ok || message.Type == sdpMessage {
+		return nil
+	}
+	target := roomTarget{}
+	if err := json.Unmarshal(message.Data, &target); err != nil {
+		return newProtocolError(codeBadMessage, "invalid payload: %v", err)
+	}
+	if target.RoomID != "" {
+		target.ID = target.RoomID
+	}
+	role, err := s.rooms.UserRole(target.ID, user.ID)
+	if err != nil || role == "" {
+		return nil
+	}
+	if required == roleOwner && role != roleOwner {
+		return roomError(notOwnerError{user.ID}, "message %d, room %s", message.Type, target.ID)
+	}
+	if !hasRole(role, required) {
+		return roomError(errForbidden, "message %d requires role %s, room %s", message.Type, required, target.ID)
+	}
+	return nil
+}
+
+func (s *WsServer) handleMessage(from *WS, socketID string, user User, message *Message) error {
+	// legacy clients may send extra fields
+	strict := from.version > legacyProtocolVersion
 	switch message.Type {
+	case helloMessage:
+		hello := HelloPayload{}
+		if err := decodePayload(message.Data, &hello, strict); err != nil {
+			return err
+		}
+		res, err := negotiate(hello)
+		if err != nil {
+			return err
+		}
+		from.version = res.Version
+		res.MaxMessageSize = s.MaxMessageSize
+		s.setCapabilities(socketID, res.Capabilities)
+		s.send(socketID, &Message{From: socketID, Type: helloMessage, Data: composeData(res), To: socketID})
 	case textMessage:
-		roomID := messageData["id"]
-		text := messageData["text"]
-		room := s.rooms.GetRoom(roomID)
-		log.Printf("on text message at room %s", roomID)
-		if room == nil {
-			return errors.Errorf("send message error, no room  %s", roomID)
+		payload := TextPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
 		}
-		newMessage := RoomMessage{Author: user.PeerID, Text: text, Timestamp: time.Now().String()}
-		room.Messages = append(room.Messages, newMessage)
-		data := composeData(map[string]interface{}{"timestamp": newMessage.Timestamp, "author": newMessage.Author, "text": text})
-		msg := &Message{From: socketID, Type: textMessage, Data: data, To: socketID}
-		for _, user := range room.Users {
-			to := s.clients[user.PeerID]
-			err = send(to, msg)
+		log.Printf("on text message at room %s", payload.RoomID)
+		if payload.To != "" {
+			return s.sendDirect(socketID, user, payload)
+		}
+		newMessage := RoomMessage{Author: user.PeerID, Text: payload.Text, ReplyTo: payload.ReplyTo}
+		room, err := s.rooms.AddMessage(payload.RoomID, newMessage)
+		if err != nil {
+			return roomError(err, "send message error, room %s", payload.RoomID)
+		}
+		newMessage = room.Messages[len(room.Messages)-1]
+		msg := &Message{From: socketID, Type: textMessage, Data: composeData(newMessage), To: socketID}
+		s.sendToAllRoom(room, msg)
+	case editMessage:
+		payload := EditMessagePayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		edited, err := s.rooms.EditMessage(payload.RoomID, user.PeerID, payload.MessageID, payload.Text)
+		if err != nil {
+			return roomError(err, "edit message error, room %s", payload.RoomID)
+		}
+		if room := s.rooms.GetRoom(payload.RoomID); room != nil {
+			s.sendToAllRoom(room, &Message{From: socketID, Type: editMessage, Data: composeData(edited)})
+		}
+	case eventMessage:
+		payload := EventPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
 		}
+		return s.handleEvent(from, socketID, payload)
+	case reactionMessage:
+		payload := ReactionPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		room, added, err := s.rooms.ToggleReaction(payload.RoomID, user.PeerID, payload.MessageID, payload.Emoji)
+		if err != nil {
+			return roomError(err, "reaction error, room %s", payload.RoomID)
+		}
+		event := ReactionEventPayload{RoomID: room.ID, MessageID: payload.MessageID, Emoji: payload.Emoji, UserID: user.ID, Added: added}
+		s.sendToAllRoom(room, &Message{From: socketID, Type: reactionMessage, Data: composeData(event)})
+	case deleteMessage:
+		payload := DeleteMessagePayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		room, err := s.rooms.DeleteMessage(payload.RoomID, user.PeerID, payload.MessageID)
+		if err != nil {
+			return roomError(err, "delete message error, room %s", payload.RoomID)
+		}
+		s.sendToAllRoom(room, &Message{From: socketID, Type: deleteMessage, Data: composeData(payload)})
 	case createRoomMessage:
-		room, err := s.rooms.CreateRoom(user)
+		payload := CreateRoomPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		room, err := s.rooms.CreateRoom(user, payload.Settings, payload.Password)
 		if err != nil {
-			return errors.Errorf("create room error")
+			return newProtocolError(codeInternal, "create room error: %v", err)
 		}
-		to := s.clients[socketID]
-		data := RoomToMap(room)
-		err = send(to, &Message{From: socketID, Type: roomIsCreatedMessage, Data: data, To: socketID})
+		data := RoomToMapFor(room, socketID)
+		s.send(socketID, &Message{From: socketID, Type: roomIsCreatedMessage, Data: data, To: socketID})
+		s.replan(room.ID)
 	case joinRoomMessage:
-		roomID := messageData["id"]
-		peerID := messageData["peerId"]
-		room, err := s.rooms.JoinToRoom(roomID, user)
-		if err != nil || peerID == "" {
-			return errors.Errorf("join room error %s %s %v", roomID, message.To, err)
+		payload := JoinRoomPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		roomID := payload.RoomID
+		var room *Room
+		var err error
+		if payload.Invite != "" {
+			invite, inviteErr := s.auth.ParseInvite(payload.Invite)
+			if inviteErr != nil {
+				return newProtocolError(codeInvalidInvite, "join room error, room %s: %v", roomID, inviteErr)
+			}
+			room, err = s.rooms.JoinWithInvite(roomID, user, *invite)
+		} else {
+			room, err = s.rooms.JoinToRoom(roomID, user, payload.Password)
 		}
-		masterPeer := room.Owner //temp, all peers connects to room owner
-		to := s.clients[masterPeer]
-		data := composeData(map[string]interface{}{"peerId": socketID})
-		err = send(to, &Message{From: socketID, Type: startPeerConnectionMessage, Data: data, To: message.To})
 		if err != nil {
-			return errors.Errorf("join room error cannot send start connect message %s %s %v", masterPeer, roomID, err)
+			return roomError(err, "join room error, room %s", roomID)
 		}
 		log.Printf("joinRoomMessage to %s %s", roomID, message.To)
-		data = RoomToMap(room)
-		msg := &Message{From: socketID, Type: roomUpdateMessage, Data: data, To: message.To}
-		err = s.sendToAllRoom(room, msg)
+		if !hasUser(room.Users, socketID) {
+			// room with lobby, the peer waits for a moderator
+			s.notifyLobby(room, user, lobbyWaiting)
+			return nil
+		}
+		s.sendRoomUpdate(room, socketID, "", socketID)
+		s.replan(roomID)
 	case leaveRoomMessage:
-		roomID := messageData["id"]
+		payload := LeaveRoomPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		roomID := payload.RoomID
 		room, err := s.rooms.LeaveRoom(roomID, socketID)
-		if err != nil || room == nil {
-			return errors.Errorf("leave room error %s %s", roomID, err)
+		if err != nil {
+			return roomError(err, "leave room error, room %s", roomID)
 		}
 		log.Printf("leaveRoomMessage to %s %s", roomID, message.To)
-		data := RoomToMap(room)
-		msg := &Message{From: socketID, Type: roomUpdateMessage, Data: data, To: message.To}
-		err = s.sendToRoom(room, msg, socketID)
+		if room == nil {
+			log.Printf("room is blank and removed %s", roomID)
+			return nil
+		}
+		s.sendRoomUpdate(room, socketID, socketID)
+		s.replan(roomID)
+	case transferOwnershipMessage:
+		payload := TransferOwnershipPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		transfer := s.rooms.TransferOwnership
+		if payload.Successor {
+			transfer = s.rooms.SetSuccessor
+		}
+		room, err := transfer(payload.RoomID, socketID, payload.PeerID)
+		if err != nil {
+			return roomError(err, "transfer ownership error, room %s", payload.RoomID)
+		}
+		log.Printf("transferOwnership of %s to %s", payload.RoomID, payload.PeerID)
+		s.sendRoomUpdate(room, socketID, "")
+		s.replan(payload.RoomID)
+	case kickMessage, banMessage:
+		payload := ModeratePayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		event := ModerationPayload{RoomID: payload.RoomID, Action: actionKick, By: user.ID, PeerID: payload.PeerID}
+		var room *Room
+		var err error
+		if message.Type == banMessage {
+			event.Action = actionBan
+			room, event.UserID, err = s.rooms.Ban(payload.RoomID, user.ID, payload.PeerID)
+		} else {
+			room, err = s.rooms.Kick(payload.RoomID, user.ID, payload.PeerID)
+		}
+		if err != nil {
+			return roomError(err, "%s error, room %s", event.Action, payload.RoomID)
+		}
+		log.Printf("%s %s from %s by %s", event.Action, payload.PeerID, payload.RoomID, user.ID)
+		s.notifyModeration(room, event)
+	case muteMessage:
+		payload := MutePayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		room, err := s.rooms.Mute(payload.RoomID, user.ID, payload.PeerID, payload.Media, payload.Muted)
+		if err != nil {
+			return roomError(err, "mute error, room %s", payload.RoomID)
+		}
+		event := ModerationPayload{RoomID: payload.RoomID, Action: actionMute, By: user.ID, PeerID: payload.PeerID, Media: payload.Media}
+		if !payload.Muted {
+			event.Action = actionUnmute
+		}
+		s.notifyModeration(room, event)
+	case admitMessage, denyMessage:
+		payload := ModeratePayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		decide, state := s.rooms.Admit, lobbyAdmitted
+		if message.Type == denyMessage {
+			decide, state = s.rooms.Deny, lobbyDenied
+		}
+		room, err := decide(payload.RoomID, user.ID, payload.PeerID)
+		if err != nil {
+			return roomError(err, "lobby error, room %s", payload.RoomID)
+		}
+		log.Printf("lobby of %s: %s is %s by %s", payload.RoomID, payload.PeerID, state, user.ID)
+		s.notifyLobby(room, User{PeerID: payload.PeerID}, state)
+		s.sendRoomUpdate(room, socketID, "", payload.PeerID)
+		if state == lobbyAdmitted {
+			s.replan(payload.RoomID)
+		}
+	case setRoleMessage:
+		payload := SetRolePayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		room, err := s.rooms.SetRole(payload.RoomID, user.ID, payload.PeerID, payload.Role)
+		if err != nil {
+			return roomError(err, "set role error, room %s", payload.RoomID)
+		}
+		log.Printf("setRole %s of %s in %s by %s", payload.Role, payload.PeerID, payload.RoomID, user.ID)
+		s.sendRoomUpdate(room, socketID, "")
 	case addFakeUser:
-		roomID := messageData["roomId"]
-		id := messageData["id"]
-		log.Printf("addFakeUser to %s %s", roomID, id)
-		room, err := s.rooms.AddFakeUser(roomID, &User{ID: id, Name: messageData["name"], PictureURL: messageData["pictureUrl"]})
-		if room == nil || err != nil {
-			return errors.Errorf("add fake user to room error %s", roomID)
-		}
-		data := RoomToMap(room)
-		msg := &Message{From: socketID, Type: roomUpdateMessage, Data: data, To: message.To}
-		err = s.sendToAllRoom(room, msg)
+		payload := FakeUserPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		log.Printf("addFakeUser to %s %s", payload.RoomID, payload.ID)
+		room, err := s.rooms.AddFakeUser(payload.RoomID, user.ID, &User{ID: payload.ID, Name: payload.Name, PictureURL: payload.PictureURL})
+		if err != nil {
+			return roomError(err, "add fake user to room error %s", payload.RoomID)
+		}
+		s.sendRoomUpdate(room, socketID, "")
 	case removeFakeUser:
-		roomID := messageData["roomId"]
-		id := messageData["id"]
-		log.Printf("removeFakeUser to %s %s", roomID, id)
-		room, err := s.rooms.RemoveFakeUser(roomID, id)
-		if room == nil || err != nil {
-			return errors.Errorf("remove fake user to room error %s", roomID)
-		}
-		data := RoomToMap(room)
-		msg := &Message{From: socketID, Type: roomUpdateMessage, Data: data, To: message.To}
-		err = s.sendToAllRoom(room, msg)
-	case sdpMessage:
-		to := s.clients[message.To]
-		err = send(to, &Message{From: socketID, Type: sdpMessage, Data: message.Data, To: message.To})
-	case candidateMessage:
-		to := s.clients[message.To]
-		err = send(to, &Message{From: socketID, Type: candidateMessage, Data: message.Data, To: message.To})
+		payload := FakeUserPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		log.Printf("removeFakeUser to %s %s", payload.RoomID, payload.ID)
+		room, err := s.rooms.RemoveFakeUser(payload.RoomID, user.ID, payload.ID)
+		if err != nil {
+			return roomError(err, "remove fake user to room error %s", payload.RoomID)
+		}
+		s.sendRoomUpdate(room, socketID, "")
+	case syncRoomMessage:
+		payload := SyncRoomPayload{}
+		if err := decodePayload(message.Data, &payload, strict); err != nil {
+			return err
+		}
+		// snapshot is queued under the room lock, so later changes follow it
+		member := false
+		found := s.rooms.withRoom(payload.RoomID, func(room *Room) {
+			if member = hasUser(room.Users, socketID); member && room.Version != payload.Version {
+				s.send(socketID, &Message{From: room.ID, Type: roomUpdateMessage, Data: RoomToMapFor(room, socketID), To: socketID})
+			}
+		})
+		if !found {
+			return roomError(errRoomNotFound, "sync room error, room %s", payload.RoomID)
+		}
+		if !member {
+			return roomError(errNotMember, "sync room error, room %s", payload.RoomID)
+		}
+	case sdpMessage, candidateMessage:
+		// signaling data is forwarded as is, it is decoded only to be validated
+		var payload interface{} = &SDPPayload{}
+		if message.Type == candidateMessage {
+			payload = &CandidatePayload{}
+		}
+		if err := decodePayload(message.Data, payload, strict); err != nil {
+			return err
+		}
+		if sdp, ok := payload.(*SDPPayload); ok {
+			if media := sdpSendsMedia(sdp.SDP); len(media) > 0 && !s.rooms.CanPublish(socketID, message.To, media) {
+				return newProtocolError(codeForbidden, "peer %s is not allowed to publish %s to %s", socketID, strings.Join(media, ", "), message.To)
+			}
+		}
+		err := s.send(message.To, &Message{From: socketID, Type: message.Type, Data: message.Data, To: message.To})
+		if err == errPeerNotFound {
+			return newProtocolError(codePeerNotFound, "peer %s is not connected", message.To)
+		}
+		return err
+	default:
+		return newProtocolError(codeUnknownType, "unknown message type %d", message.Type)
 	}
-	return err
+	return nil
 }
 
-func (s *WsServer) sendToAllRoom(room *Room, msg *Message) error {
-	var err error = nil
-	for _, user := range room.Users {
-		to := s.clients[user.PeerID]
-		err = send(to, msg)
+// sendError reports failed message to the peer
+func (s *WsServer) sendError(socketID string, message *Message, err error) {
+	perr, ok := err.(*ProtocolError)
+	if !ok {
+		perr = newProtocolError(codeInternal, "%v", err)
 	}
-	return err
+	data := composeData(ErrorPayload{Code: perr.Code, Message: perr.Message, Type: message.Type})
+	s.send(socketID, &Message{From: socketID, Type: errorMessage, RequestID: message.RequestID, Data: data, To: socketID})
+}
+
+func (s *WsServer) sendToAllRoom(room *Room, msg *Message) error {
+	return s.sendToRoom(room, msg, "")
 }
 func (s *WsServer) sendToRoom(room *Room, msg *Message, origin string) error {
-	var err error = nil
+	log.Printf("send %d to room %s", msg.Type, room.ID)
+	bts, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
 	for _, user := range room.Users {
 		if user.PeerID != origin {
-			to := s.clients[user.PeerID]
-			err = send(to, msg)
+			if e := s.deliver(user.PeerID, bts); e != nil && e != errPeerNotFound {
+				err = e
+			}
 		}
 	}
 	return err
 }
 
+// replan tells peers of the room which connections to open and to close according to the room topology
+func (s *WsServer) replan(roomID string) {
+	open, closed, err := s.rooms.Replan(roomID)
+	if err != nil {
+		log.Printf("replan room error %s %v", roomID, err)
+		return
+	}
+	for _, link := range closed {
+		s.send(link.From, &Message{From: link.To, Type: stopPeerConnectionMessage, Data: composeData(PeerPayload{PeerID: link.To}), To: link.From})
+		s.send(link.To, &Message{From: link.From, Type: stopPeerConnectionMessage, Data: composeData(PeerPayload{PeerID: link.From}), To: link.To})
+	}
+	for _, link := range open {
+		s.send(link.From, &Message{From: link.To, Type: startPeerConnectionMessage, Data: composeData(PeerPayload{PeerID: link.To}), To: link.From})
+	}
+}
+
 func (s *WsServer) onCloseConnection(user User) {
-	rooms, err := s.rooms.GetUserRooms(user.PeerID)
+	for _, room := range s.rooms.LeaveLobbies(user.PeerID) {
+		s.sendRoomUpdate(&room, "offline", user.PeerID)
+	}
+	rooms, err := s.rooms.GetPeerRooms(user.PeerID)
 	if err != nil {
 		log.Printf("onCloseConnection no rooms for %s", user.PeerID)
 		return
@@ -199,32 +520,216 @@ func (s *WsServer) onCloseConnection(user User) {
 		updatedRoom, err := s.rooms.LeaveRoom(room.ID, user.PeerID)
 		if err != nil {
 			log.Printf("leave room error %s %s", room.ID, err)
-			return
+			continue
 		}
 		if updatedRoom == nil {
 			log.Printf("room is blank and removed %s", room.ID)
-			return
+			continue
+		}
+		s.sendRoomUpdate(updatedRoom, "offline", user.PeerID)
+		s.replan(room.ID)
+	}
+}
+
+// sendDirect stores direct message and sends it to all peers of the recipient and the author
+func (s *WsServer) sendDirect(socketID string, user User, payload TextPayload) error {
+	if payload.ReplyTo != 0 {
+		return newProtocolError(codeBadMessage, "direct message cannot be a reply")
+	}
+	direct, err := s.rooms.AddDirectMessage(payload.RoomID, RoomMessage{Author: user.PeerID, Text: payload.Text, To: payload.To})
+	if err != nil {
+		return roomError(err, "send direct message error, room %s", payload.RoomID)
+	}
+	bts, err := json.Marshal(&Message{From: socketID, Type: textMessage, Data: composeData(direct), To: payload.To})
+	if err != nil {
+		return err
+	}
+	for _, peerID := range append(s.peersOf(payload.To), s.peersOf(user.ID)...) {
+		if err := s.deliver(peerID, bts); err != nil && err != errPeerNotFound {
+			log.Printf("direct message to %s error %v", peerID, err)
 		}
-		data := RoomToMap(updatedRoom)
-		for _, u := range updatedRoom.Users {
-			if u.PeerID != user.PeerID {
-				to := s.clients[u.PeerID]
-				err = send(to, &Message{From: "offline", Type: roomUpdateMessage, Data: data, To: "all"})
+	}
+	return nil
+}
+
+// notifyModeration sends moderation event and room update to the room,
+// removed peers get the event as well, so they know why they are not in the room
+func (s *WsServer) notifyModeration(room *Room, event ModerationPayload) {
+	msg := &Message{From: event.By, Type: moderationMessage, Data: composeData(event), To: "all"}
+	s.sendToAllRoom(room, msg)
+	targets := []string{}
+	if event.Action == actionBan {
+		targets = s.peersOf(event.UserID)
+	}
+	if event.PeerID != "" && !contains(targets, event.PeerID) {
+		targets = append(targets, event.PeerID)
+	}
+	for _, peerID := range targets {
+		if !hasUser(room.Users, peerID) {
+			msg.To = peerID
+			if err := s.send(peerID, msg); err != nil && err != errPeerNotFound {
+				log.Printf("moderation event to %s error %v", peerID, err)
 			}
 		}
 	}
+	s.notifyRoomUpdate(room, event.By)
 }
 
-func send(to *WS, message *Message) error {
+// notifyRoomUpdate sends the room changed by the user to its peers and replans peer connections
+func (s *WsServer) notifyRoomUpdate(room *Room, by string) {
+	s.sendRoomUpdate(room, by, "")
+	s.replan(room.ID)
+}
+
+// sendRoomUpdate sends room snapshot to joined peers and peers which do not support room events,
+// other peers get changes of the room when they are made, origin peer is skipped
+func (s *WsServer) sendRoomUpdate(room *Room, from string, origin string, joined ...string) {
+	// snapshots are queued under the room lock, so they are ordered with changes
+	s.rooms.withRoom(room.ID, func(room *Room) {
+		// lobby is sent to room managers only, so managers and other peers get their own snapshots
+		snapshot := map[bool][]byte{}
+		for _, user := range room.Users {
+			if user.PeerID == "" || user.PeerID == origin {
+				continue
+			}
+			if !contains(joined, user.PeerID) && s.hasCapability(user.PeerID, capRoomEvents) {
+				continue
+			}
+			manager := hasRole(user.Role, manageRole)
+			if snapshot[manager] == nil {
+				snapshot[manager], _ = json.Marshal(&Message{From: from, Type: roomUpdateMessage, Data: roomToMap(room, manager), To: "all"})
+			}
+			if err := s.deliver(user.PeerID, snapshot[manager]); err != nil && err != errPeerNotFound {
+				log.Printf("room update to %s error %v", user.PeerID, err)
+			}
+		}
+	})
+}
+
+// publishChanges sends changes of the locked room to its peers which support room events,
+// it is called by room service, the peer joined by the change gets room snapshot instead
+func (s *WsServer) publishChanges(room *Room, changes []RoomChange) {
+	log.Printf("send %d changes of room %s", len(changes), room.ID)
+	messages := make([][]byte, len(changes))
+	for i, change := range changes {
+		messages[i], _ = json.Marshal(&Message{From: room.ID, Type: roomChangeMessage, Data: composeData(change), To: "all"})
+	}
+	for _, user := range room.Users {
+		if user.PeerID == "" || !s.hasCapability(user.PeerID, capRoomEvents) {
+			continue
+		}
+		manager := hasRole(user.Role, manageRole)
+		for i, change := range changes {
+			if (change.Kind == changePending && !manager) || (change.Kind == changeJoined && change.User.PeerID == user.PeerID) {
+				continue
+			}
+			if err := s.deliver(user.PeerID, messages[i]); err != nil && err != errPeerNotFound {
+				log.Printf("room change to %s error %v", user.PeerID, err)
+			}
+		}
+	}
+}
+
+// setCapabilities keeps capabilities of the peer negotiated in hello
+func (s *WsServer) setCapabilities(socketID string, caps []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess := s.sessions[socketID]; sess != nil {
+		sess.caps = caps
+	}
+}
+
+// hasCapability checks that the peer negotiated the capability
+func (s *WsServer) hasCapability(peerID string, capability string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess := s.sessions[peerID]
+	return sess != nil && contains(sess.caps, capability)
+}
+
+// notifyLobby sends lobby state of the peer to the peer and room managers
+func (s *WsServer) notifyLobby(room *Room, user User, state string) {
+	msg := &Message{From: room.ID, Type: lobbyMessage, Data: composeData(LobbyPayload{RoomID: room.ID, State: state, User: user}), To: user.PeerID}
+	for _, peerID := range append(managers(room), user.PeerID) {
+		if err := s.send(peerID, msg); err != nil && err != errPeerNotFound {
+			log.Printf("lobby event to %s error %v", peerID, err)
+		}
+	}
+}
+
+// peersOf returns ids of connected or reconnecting peers of the user
+func (s *WsServer) peersOf(userID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	peers := []string{}
+	for id := range s.userPeers[userID] {
+		peers = append(peers, id)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func (s *WsServer) getClient(socketID string) *WS {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clients[socketID]
+}
+
+func (s *WsServer) clientsCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.clients)
+}
+
+// Stats returns outbound traffic counters
+func (s *WsServer) Stats() WsStats {
+	return WsStats{
+		Sent:      atomic.LoadUint64(&s.stats.Sent),
+		Dropped:   atomic.LoadUint64(&s.stats.Dropped),
+		Evicted:   atomic.LoadUint64(&s.stats.Evicted),
+		Throttled: atomic.LoadUint64(&s.stats.Throttled),
+	}
+}
+
+// StatsHandler renders outbound traffic counters
+func (s *WsServer) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, s.Stats())
+}
+
+// send queues message to the socket, it never blocks on a slow peer
+func (s *WsServer) send(socketID string, message *Message) error {
 	log.Printf("send %d to %s", message.Type, message.To)
 	bts, err := json.Marshal(message)
-	if err != nil || to == nil || to.Conn == nil {
+	if err != nil {
 		return err
 	}
-	return wsutil.WriteServerBinary(to.Conn, bts)
+	return s.deliver(socketID, bts)
+}
+
+// deliver queues message to the socket connection, messages to a reconnecting peer are kept till it is back
+func (s *WsServer) deliver(socketID string, bts []byte) error {
+	if to := s.getClient(socketID); to != nil {
+		return to.push(bts, s.OverflowPolicy, &s.stats)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if to := s.clients[socketID]; to != nil {
+		return to.push(bts, s.OverflowPolicy, &s.stats)
+	}
+	sess := s.sessions[socketID]
+	if sess == nil {
+		return errPeerNotFound // fake users and gone peers
+	}
+	if len(sess.pending) >= s.SendQueueSize {
+		atomic.AddUint64(&s.stats.Dropped, 1)
+		return errors.Errorf("message to %s is dropped, pending queue is full", socketID)
+	}
+	sess.pending = append(sess.pending, bts)
+	return nil
 }
 
-func composeData(data map[string]interface{}) json.RawMessage {
+func composeData(data interface{}) json.RawMessage {
 	bts, _ := json.Marshal(data)
 	return bts
 }
@@ -3,8 +3,14 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,42 +23,1041 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestSocketHandler(t *testing.T) {
-	secret := "test"
-	rooms := NewRoomService()
+const testSecret = "test"
+
+func startupWsT(t *testing.T) (ts *httptest.Server, rooms *RoomService, wsServer *WsServer, teardown func()) {
+	rooms = NewRoomService()
 	logger := logger.New()
-	auth1 := auth.NewAuth(secret, logger, "test-url")
-	wsServer := NewWsServer(rooms, auth1, logger)
+	auth1 := auth.NewAuth(testSecret, logger, "test-url")
+	wsServer = NewWsServer(rooms, auth1, logger)
 	router := chi.NewRouter()
 	router.HandleFunc("/ws", wsServer.SocketHandler)
-	s := httptest.NewServer(router)
-	defer s.Close()
+	ts = httptest.NewServer(router)
+
+	teardown = func() {
+		ts.Close()
+	}
+	return ts, rooms, wsServer, teardown
+}
+
+func dialWsT(t *testing.T, ts *httptest.Server, userID, socketID string) *websocket.Conn {
+	ws, _ := connectWsT(t, ts, userID, socketID, "")
+	return ws
+}
+
+// connectWsT opens connection and reads session message
+func connectWsT(t *testing.T, ts *httptest.Server, userID, socketID, resumeToken string) (*websocket.Conn, map[string]interface{}) {
+	ws := openWsT(t, ts, userID, socketID, resumeToken)
+	msg, err := readWsT(ws)
+	require.Nil(t, err)
+	require.Equal(t, sessionMessage, msg.Type)
+	data := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(msg.Data, &data))
+	return ws, data
+}
 
-	jwtService := auth.NewJWT(secret)
-	claims := auth.Claims{User: &auth.User{ID: "test"}, StandardClaims: jwt.StandardClaims{
+func openWsT(t *testing.T, ts *httptest.Server, userID, socketID, resumeToken string) *websocket.Conn {
+	jwtService := auth.NewJWT(testSecret)
+	claims := auth.Claims{User: &auth.User{ID: userID}, StandardClaims: jwt.StandardClaims{
 		ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
 	}}
 	token := jwtService.NewJwtToken(claims)
 
-	url := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?token=" + token + "&id=test"
-	t.Log("ws connect: " + url)
-
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=" + token + "&id=" + socketID + "&resume=" + resumeToken
 	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
-	assert.Nil(t, err)
-	defer ws.Close()
-	data := composeData(map[string]interface{}{"text": "test", "id": "test"})
+	require.Nil(t, err)
+	return ws
+}
+
+// requireClosedWsT reads till the connection is closed by server with the code
+func requireClosedWsT(t *testing.T, ws *websocket.Conn, code int) {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, err := readWsT(ws)
+		if err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			require.True(t, ok, "unexpected error %v", err)
+			require.Equal(t, code, closeErr.Code)
+			return
+		}
+	}
+}
+
+// addClientT registers connection of the socket id without session
+func addClientT(s *WsServer, socketID string, client *WS) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[socketID] = client
+}
+
+func writeWsT(ws *websocket.Conn, messageType int, data map[string]interface{}) error {
+	return writeToWsT(ws, messageType, data, "id")
+}
 
-	message := Message{From: "sender", Type: createRoomMessage, Data: data, To: "id"}
+func writeToWsT(ws *websocket.Conn, messageType int, data map[string]interface{}, to string) error {
+	message := Message{From: "sender", Type: messageType, Data: composeData(data), To: to}
 	bts, _ := json.Marshal(message)
-	err = ws.WriteMessage(websocket.TextMessage, bts)
-	assert.Nil(t, err)
+	return ws.WriteMessage(websocket.TextMessage, bts)
+}
+
+func readWsT(ws *websocket.Conn) (Message, error) {
+	msg := Message{}
 	_, p, err := ws.ReadMessage()
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(p, &msg)
+	return msg, err
+}
+
+func TestSocketHandler(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	ws := dialWsT(t, s, "test", "test")
+	defer ws.Close()
+
+	err := writeWsT(ws, createRoomMessage, map[string]interface{}{"text": "test", "id": "test"})
 	assert.Nil(t, err)
-	msg := Message{}
-	json.Unmarshal(p, &msg)
-	messageData := InputMessageData{}
+	msg, err := readWsT(ws)
+	assert.Nil(t, err)
+	messageData := map[string]interface{}{}
 	json.Unmarshal(msg.Data, &messageData)
 
 	text := fmt.Sprintf("%v", messageData["owner"])
 	require.Equal(t, "test", text)
 }
+
+func TestSocketHandlerStress(t *testing.T) {
+	const (
+		owners  = 20
+		members = 300
+	)
+	s, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.ResumeGrace = 0
+
+	roomIDs := make([]string, owners)
+	ownerConns := make([]*websocket.Conn, owners)
+	var readers sync.WaitGroup
+	drain := func(ws *websocket.Conn) {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				if _, err := readWsT(ws); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < owners; i++ {
+		ws := dialWsT(t, s, fmt.Sprintf("owner%d", i), fmt.Sprintf("owner-peer%d", i))
+		roomIDs[i] = createRoomT(t, ws)
+		ownerConns[i] = ws
+		drain(ws)
+	}
+
+	// connections are opened by the test goroutine, require cannot stop the test from other goroutines
+	memberConns := make([]*websocket.Conn, members)
+	for i := 0; i < members; i++ {
+		memberConns[i] = dialWsT(t, s, fmt.Sprintf("user%d", i), fmt.Sprintf("peer%d", i))
+		drain(memberConns[i])
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < members; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			peerID := fmt.Sprintf("peer%d", i)
+			ws := memberConns[i]
+			defer ws.Close()
+			roomID := roomIDs[i%owners]
+			assert.Nil(t, writeWsT(ws, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": peerID}))
+			assert.Nil(t, writeWsT(ws, textMessage, map[string]interface{}{"id": roomID, "text": "hello"}))
+			if i%2 == 0 {
+				// the rest just drop connection
+				assert.Nil(t, writeWsT(ws, leaveRoomMessage, map[string]interface{}{"id": roomID}))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, ws := range ownerConns {
+		ws.Close()
+	}
+	readers.Wait()
+
+	// rooms wait for the owners
+	assert.Eventually(t, func() bool {
+		for _, id := range roomIDs {
+			if room := rooms.GetRoom(id); room == nil || len(room.Users) > 0 {
+				return false
+			}
+		}
+		return wsServer.clientsCount() == 0
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestBroadcastSlowPeer(t *testing.T) {
+	_, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.OverflowPolicy = DropOnOverflow
+
+	room, err := rooms.CreateRoom(User{ID: "slow", PeerID: "slow-peer"}, RoomSettings{}, "")
+	require.NoError(t, err)
+	room, err = rooms.JoinToRoom(room.ID, User{ID: "fast", PeerID: "fast-peer"}, "")
+	require.NoError(t, err)
+
+	slowServer, slowClient := net.Pipe() // never read
+	defer slowClient.Close()
+	slow := newWS(slowServer, "slow", 4)
+	go slow.writeLoop(time.Minute, 0, &wsServer.stats)
+	defer slow.close()
+	fastServer, fastClient := net.Pipe()
+	defer fastClient.Close()
+	fast := newWS(fastServer, "fast", 4)
+	go fast.writeLoop(time.Minute, 0, &wsServer.stats)
+	defer fast.close()
+	go io.Copy(ioutil.Discard, fastClient)
+	addClientT(wsServer, "slow-peer", slow)
+	addClientT(wsServer, "fast-peer", fast)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			wsServer.sendToAllRoom(room, &Message{Type: textMessage, To: "all"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast is blocked by slow peer")
+	}
+	// one message is stalled in the writer, 4 are queued
+	assert.True(t, slow.Dropped() >= 95)
+	assert.True(t, wsServer.Stats().Dropped >= slow.Dropped())
+}
+
+func TestDeadPeerDetection(t *testing.T) {
+	s, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.PingInterval = 50 * time.Millisecond
+	wsServer.IdleTimeout = 300 * time.Millisecond
+	wsServer.ResumeGrace = 0
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	go func() {
+		// gorilla client answers pings while it reads
+		for {
+			if _, err := readWsT(owner); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the peer never reads, so it never answers pings
+	dead := dialWsT(t, s, "dead", "dead-peer")
+	defer dead.Close()
+	require.Nil(t, writeWsT(dead, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "dead-peer"}))
+	require.Eventually(t, func() bool {
+		room := rooms.GetRoom(roomID)
+		return room != nil && len(room.Users) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		room := rooms.GetRoom(roomID)
+		return room != nil && len(room.Users) == 1
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Nil(t, wsServer.getClient("dead-peer"))
+
+	// alive peer is kept after a few idle timeouts
+	time.Sleep(3 * wsServer.IdleTimeout)
+	room := rooms.GetRoom(roomID)
+	require.NotNil(t, room)
+	assert.Equal(t, "owner-peer", room.Users[0].PeerID)
+}
+
+func createRoomT(t *testing.T, ws *websocket.Conn) string {
+	require.Nil(t, writeWsT(ws, createRoomMessage, nil))
+	msg, err := readWsT(ws)
+	require.Nil(t, err)
+	require.Equal(t, roomIsCreatedMessage, msg.Type)
+	data := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(msg.Data, &data))
+	return data["id"].(string)
+}
+
+// readTypeWsT reads messages till the message of given type and returns its data
+func readTypeWsT(t *testing.T, ws *websocket.Conn, messageType int) map[string]interface{} {
+	msg := nextTypeWsT(t, ws, messageType)
+	data := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(msg.Data, &data))
+	return data
+}
+
+func nextTypeWsT(t *testing.T, ws *websocket.Conn, messageType int) Message {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		msg, err := readWsT(ws)
+		require.Nil(t, err)
+		if msg.Type == messageType {
+			return msg
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	s, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.ResumeGrace = time.Second
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+
+	peer, session := connectWsT(t, s, "peer", "peer1", "")
+	assert.Equal(t, false, session["resumed"])
+	require.Nil(t, writeWsT(peer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer1"}))
+	readTypeWsT(t, peer, roomUpdateMessage)
+	peer.Close()
+
+	state := readTypeWsT(t, owner, peerStateMessage)
+	assert.Equal(t, "peer1", state["peerId"])
+	assert.Equal(t, peerReconnecting, state["state"])
+	room := rooms.GetRoom(roomID)
+	require.Equal(t, 2, len(room.Users))
+	assert.Equal(t, peerReconnecting, room.Users[1].State)
+
+	// message to reconnecting peer is kept
+	require.Nil(t, writeWsT(owner, textMessage, map[string]interface{}{"id": roomID, "text": "are you there?"}))
+
+	peer, resumed := connectWsT(t, s, "peer", "peer1", session["resumeToken"].(string))
+	defer peer.Close()
+	assert.Equal(t, true, resumed["resumed"])
+	assert.Equal(t, session["resumeToken"], resumed["resumeToken"])
+	text := readTypeWsT(t, peer, textMessage)
+	assert.Equal(t, "are you there?", text["text"])
+
+	state = readTypeWsT(t, owner, peerStateMessage)
+	assert.Equal(t, peerReconnected, state["state"])
+	room = rooms.GetRoom(roomID)
+	require.Equal(t, 2, len(room.Users))
+	assert.Equal(t, "", room.Users[1].State)
+}
+
+func TestSessionExpire(t *testing.T) {
+	s, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.ResumeGrace = 100 * time.Millisecond
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+
+	peer, session := connectWsT(t, s, "peer", "peer1", "")
+	require.Nil(t, writeWsT(peer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer1"}))
+	readTypeWsT(t, peer, roomUpdateMessage)
+	peer.Close()
+	readTypeWsT(t, owner, peerStateMessage)
+
+	update := readTypeWsT(t, owner, roomUpdateMessage)
+	assert.Equal(t, 1, len(update["users"].([]interface{})))
+	assert.Equal(t, 1, len(rooms.GetRoom(roomID).Users))
+
+	// expired token starts a new session
+	peer, resumed := connectWsT(t, s, "peer", "peer1", session["resumeToken"].(string))
+	defer peer.Close()
+	assert.Equal(t, false, resumed["resumed"])
+	assert.NotEqual(t, session["resumeToken"], resumed["resumeToken"])
+}
+
+func TestSessionResumeInvalidToken(t *testing.T) {
+	s, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.ResumeGrace = time.Minute
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+
+	peer, session := connectWsT(t, s, "peer", "peer1", "")
+	require.Nil(t, writeWsT(peer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer1"}))
+	readTypeWsT(t, peer, roomUpdateMessage)
+	peer.Close()
+	readTypeWsT(t, owner, peerStateMessage)
+
+	// another user cannot resume the session even with the token
+	other := openWsT(t, s, "other", "peer1", session["resumeToken"].(string))
+	defer other.Close()
+	requireClosedWsT(t, other, int(closeIDTaken))
+
+	// stale session is closed without waiting for grace period
+	peer, resumed := connectWsT(t, s, "peer", "peer1", "invalid")
+	defer peer.Close()
+	assert.Equal(t, false, resumed["resumed"])
+	update := readTypeWsT(t, owner, roomUpdateMessage)
+	assert.Equal(t, 1, len(update["users"].([]interface{})))
+	assert.Equal(t, 1, len(rooms.GetRoom(roomID).Users))
+
+	// new connection keeps the room it joined
+	require.Nil(t, writeWsT(peer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer1"}))
+	readTypeWsT(t, peer, roomUpdateMessage)
+	assert.Equal(t, 2, len(rooms.GetRoom(roomID).Users))
+}
+
+func TestDuplicateIDReject(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	first := dialWsT(t, s, "user", "dup")
+	defer first.Close()
+	second := openWsT(t, s, "user", "dup", "")
+	defer second.Close()
+	requireClosedWsT(t, second, int(closeIDInUse))
+
+	// the first connection is not affected
+	createRoomT(t, first)
+}
+
+func TestDuplicateIDKick(t *testing.T) {
+	s, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.DuplicateIDs = KickPrevious
+
+	first, session := connectWsT(t, s, "user", "dup", "")
+	defer first.Close()
+	roomID := createRoomT(t, first)
+	second, takeover := connectWsT(t, s, "user", "dup", "")
+	defer second.Close()
+	requireClosedWsT(t, first, int(closeReplaced))
+	assert.Equal(t, true, takeover["resumed"])
+	assert.Equal(t, session["resumeToken"], takeover["resumeToken"])
+
+	// the room is kept by the new connection
+	time.Sleep(100 * time.Millisecond)
+	room := rooms.GetRoom(roomID)
+	require.NotNil(t, room)
+	assert.Equal(t, "dup", room.Users[0].PeerID)
+	assert.NotNil(t, wsServer.getClient("dup"))
+}
+
+func TestDuplicateIDOtherUser(t *testing.T) {
+	s, _, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.DuplicateIDs = KickPrevious
+
+	first := dialWsT(t, s, "user", "dup")
+	defer first.Close()
+	second := openWsT(t, s, "intruder", "dup", "")
+	defer second.Close()
+	requireClosedWsT(t, second, int(closeIDTaken))
+	createRoomT(t, first)
+}
+
+func TestGeneratedIDs(t *testing.T) {
+	s, _, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.GenerateIDs = true
+
+	first, session := connectWsT(t, s, "user", "mine", "")
+	socketID := session["id"].(string)
+	assert.NotEqual(t, "mine", socketID)
+	first.Close()
+
+	second, resumed := connectWsT(t, s, "user", socketID, session["resumeToken"].(string))
+	defer second.Close()
+	assert.Equal(t, true, resumed["resumed"])
+	assert.Equal(t, socketID, resumed["id"])
+
+	third, other := connectWsT(t, s, "user", socketID, "")
+	defer third.Close()
+	assert.NotEqual(t, socketID, other["id"])
+}
+
+func TestProcessMessageErrors(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	other := dialWsT(t, s, "other", "other-peer")
+	defer other.Close()
+	otherRoomID := createRoomT(t, other)
+	ws := dialWsT(t, s, "user", "user-peer")
+	defer ws.Close()
+
+	message := func(messageType int, data string) string {
+		return fmt.Sprintf(`{"type":%d,"to":"test","requestId":"req%d","data":%s}`, messageType, messageType, data)
+	}
+	tt := []struct {
+		name    string
+		message string
+		code    string
+	}{
+		{"invalid json", `{"type":`, codeBadMessage},
+		{"invalid data", message(textMessage, `[1]`), codeBadMessage},
+		{"unknown type", message(99, `{}`), codeUnknownType},
+		{"text to unknown room", message(textMessage, `{"id":"none","text":"hi"}`), codeRoomNotFound},
+		{"join without peer id", message(joinRoomMessage, `{"id":"`+otherRoomID+`"}`), codeBadMessage},
+		{"join unknown room", message(joinRoomMessage, `{"id":"none","peerId":"user-peer"}`), codeRoomNotFound},
+		{"leave unknown room", message(leaveRoomMessage, `{"id":"none"}`), codeRoomNotFound},
+		{"leave not joined room", message(leaveRoomMessage, `{"id":"`+otherRoomID+`"}`), codeNotMember},
+		{"add fake user without id", message(addFakeUser, `{"roomId":"`+otherRoomID+`"}`), codeBadMessage},
+		{"add fake user to unknown room", message(addFakeUser, `{"roomId":"none","id":"fake"}`), codeRoomNotFound},
+		{"remove fake user from unknown room", message(removeFakeUser, `{"roomId":"none","id":"fake"}`), codeRoomNotFound},
+		{"text without room id", message(textMessage, `{"text":"hi"}`), codeBadMessage},
+		{"too long text", message(textMessage, `{"id":"`+otherRoomID+`","text":"`+strings.Repeat("a", 4097)+`"}`), codeBadMessage},
+		{"sdp without type", message(sdpMessage, `{"sdp":"test"}`), codeBadMessage},
+		{"sdp to unknown peer", message(sdpMessage, `{"type":"offer","sdp":"test"}`), codePeerNotFound},
+		{"candidate to unknown peer", message(candidateMessage, `{"candidate":"test","sdpMLineIndex":0}`), codePeerNotFound},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Nil(t, ws.WriteMessage(websocket.TextMessage, []byte(tc.message)))
+			msg := nextTypeWsT(t, ws, errorMessage)
+			data := map[string]interface{}{}
+			require.Nil(t, json.Unmarshal(msg.Data, &data))
+			assert.Equal(t, tc.code, data["code"])
+			assert.NotEmpty(t, data["message"])
+			if tc.code != codeBadMessage || strings.Contains(tc.message, "requestId") {
+				assert.True(t, strings.HasPrefix(msg.RequestID, "req"), "request id is not echoed")
+			}
+		})
+	}
+}
+
+func TestProcessMessageAck(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	ws := dialWsT(t, s, "user", "user-peer")
+	defer ws.Close()
+	require.Nil(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"type":1,"requestId":"create-1","data":{}}`)))
+	readTypeWsT(t, ws, roomIsCreatedMessage)
+	msg := nextTypeWsT(t, ws, ackMessage)
+	assert.Equal(t, "create-1", msg.RequestID)
+
+	// no ack without request id
+	roomID := createRoomT(t, ws)
+	require.Nil(t, writeWsT(ws, textMessage, map[string]interface{}{"id": roomID, "text": "hi"}))
+	readTypeWsT(t, ws, textMessage)
+	require.Nil(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"type":0,"requestId":"text-1","data":{"id":"`+roomID+`","text":"hi"}}`)))
+	msg = nextTypeWsT(t, ws, ackMessage)
+	assert.Equal(t, "text-1", msg.RequestID)
+}
+
+func TestHello(t *testing.T) {
+	s, _, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.MaxMessageSize = 1024
+
+	ws := dialWsT(t, s, "user", "user-peer")
+	defer ws.Close()
+
+	// legacy clients may send unknown fields
+	require.Nil(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"type":1,"data":{"extra":true}}`)))
+	readTypeWsT(t, ws, roomIsCreatedMessage)
+
+	require.Nil(t, writeWsT(ws, helloMessage, map[string]interface{}{"version": 0}))
+	e := readTypeWsT(t, ws, errorMessage)
+	assert.Equal(t, codeUnsupportedVersion, e["code"])
+
+	require.Nil(t, writeWsT(ws, helloMessage, map[string]interface{}{"version": 100, "capabilities": []string{"ack", "video"}}))
+	msg := nextTypeWsT(t, ws, helloMessage)
+	hello := HelloPayload{}
+	require.Nil(t, json.Unmarshal(msg.Data, &hello))
+	assert.Equal(t, ProtocolVersion, hello.Version)
+	assert.Equal(t, []string{"ack"}, hello.Capabilities)
+	assert.Equal(t, int64(1024), hello.MaxMessageSize)
+
+	// strict validation after hello
+	require.Nil(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"type":1,"data":{"extra":true}}`)))
+	e = readTypeWsT(t, ws, errorMessage)
+	assert.Equal(t, codeBadMessage, e["code"])
+
+	// too large message is skipped, connection is kept
+	require.Nil(t, writeWsT(ws, textMessage, map[string]interface{}{"id": "test", "text": strings.Repeat("a", 2048)}))
+	e = readTypeWsT(t, ws, errorMessage)
+	assert.Equal(t, codeTooLarge, e["code"])
+	createRoomT(t, ws)
+}
+
+func TestProtocolDescription(t *testing.T) {
+	_, _, wsServer, teardown := startupWsT(t)
+	defer teardown()
+
+	router := chi.NewRouter()
+	router.Get("/ws/protocol", wsServer.ProtocolHandler)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ws/protocol")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	description := struct {
+		Version  int `json:"version"`
+		Messages []struct {
+			Type    int                    `json:"type"`
+			Name    string                 `json:"name"`
+			Role    string                 `json:"role"`
+			Request map[string]interface{} `json:"request"`
+			Event   map[string]interface{} `json:"event"`
+		} `json:"messages"`
+	}{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&description))
+	assert.Equal(t, ProtocolVersion, description.Version)
+	require.Equal(t, len(messageSpecs), len(description.Messages))
+	join := description.Messages[2]
+	assert.Equal(t, joinRoomMessage, join.Type)
+	assert.Equal(t, []interface{}{"id", "peerId"}, join.Request["required"])
+	assert.Empty(t, join.Role)
+	assert.Equal(t, roleParticipant, description.Messages[0].Role)
+
+	// room snapshot sent to manager matches the schema of room update
+	rooms := NewRoomService()
+	room, _ := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{Lobby: true}, "")
+	room, _ = rooms.AddMessage(room.ID, RoomMessage{Author: "owner-peer", Text: "hi"})
+	room, _ = rooms.JoinToRoom(room.ID, User{ID: "guest", PeerID: "guest-peer"}, "")
+	snapshot := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(RoomToMapFor(room, "owner-peer"), &snapshot))
+	update := description.Messages[7]
+	assert.Equal(t, roomUpdateMessage, update.Type)
+	properties := update.Event["properties"].(map[string]interface{})
+	assert.Equal(t, len(properties), len(snapshot))
+	types := map[reflect.Kind]string{reflect.String: "string", reflect.Float64: "integer", reflect.Bool: "boolean",
+		reflect.Slice: "array", reflect.Map: "object"}
+	for name, value := range snapshot {
+		require.Contains(t, properties, name)
+		schema := properties[name].(map[string]interface{})
+		if value != nil {
+			assert.Equal(t, types[reflect.TypeOf(value).Kind()], schema["type"], name)
+		}
+	}
+	assert.Equal(t, "date-time", properties["created"].(map[string]interface{})["format"])
+}
+
+func TestMeshTopology(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	peers := []*websocket.Conn{}
+	for i := 0; i < 3; i++ {
+		ws := dialWsT(t, s, fmt.Sprintf("user%d", i), fmt.Sprintf("peer%d", i))
+		defer ws.Close()
+		peers = append(peers, ws)
+	}
+	require.Nil(t, writeWsT(peers[0], createRoomMessage, map[string]interface{}{"settings": map[string]interface{}{"topology": "mesh"}}))
+	msg := nextTypeWsT(t, peers[0], roomIsCreatedMessage)
+	room := Room{}
+	require.Nil(t, json.Unmarshal(msg.Data, &room))
+	assert.Equal(t, TopologyMesh, room.Settings.Topology)
+
+	for i := 1; i < 3; i++ {
+		require.Nil(t, writeWsT(peers[i], joinRoomMessage, map[string]interface{}{"id": room.ID, "peerId": fmt.Sprintf("peer%d", i)}))
+		// the joiner connects to every peer which is in the room already
+		connected := []string{}
+		for j := 0; j < i; j++ {
+			start := readTypeWsT(t, peers[i], startPeerConnectionMessage)
+			connected = append(connected, start["peerId"].(string))
+		}
+		assert.Len(t, connected, i)
+		assert.Contains(t, connected, "peer0")
+	}
+
+	// remaining peers stop their connections to the peer which left
+	require.Nil(t, writeWsT(peers[0], leaveRoomMessage, map[string]interface{}{"id": room.ID}))
+	stop := readTypeWsT(t, peers[1], stopPeerConnectionMessage)
+	assert.Equal(t, "peer0", stop["peerId"])
+	stop = readTypeWsT(t, peers[2], stopPeerConnectionMessage)
+	assert.Equal(t, "peer0", stop["peerId"])
+}
+
+func TestCreateRoomInvalidTopology(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	ws := dialWsT(t, s, "user", "peer")
+	defer ws.Close()
+	require.Nil(t, writeWsT(ws, createRoomMessage, map[string]interface{}{"settings": map[string]interface{}{"topology": "ring"}}))
+	e := readTypeWsT(t, ws, errorMessage)
+	assert.Equal(t, codeBadMessage, e["code"])
+}
+
+func TestTransferOwnership(t *testing.T) {
+	s, _, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.ResumeGrace = 0
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	peers := []*websocket.Conn{}
+	for i := 0; i < 2; i++ {
+		ws := dialWsT(t, s, fmt.Sprintf("user%d", i), fmt.Sprintf("peer%d", i))
+		defer ws.Close()
+		require.Nil(t, writeWsT(ws, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": fmt.Sprintf("peer%d", i)}))
+		readTypeWsT(t, ws, roomUpdateMessage)
+		peers = append(peers, ws)
+	}
+
+	require.Nil(t, writeWsT(peers[0], transferOwnershipMessage, map[string]interface{}{"id": roomID, "peerId": "peer0"}))
+	e := readTypeWsT(t, peers[0], errorMessage)
+	assert.Equal(t, codeNotOwner, e["code"])
+
+	require.Nil(t, writeWsT(owner, transferOwnershipMessage, map[string]interface{}{"id": roomID, "peerId": "peer1", "successor": true}))
+	room := readTypeWsT(t, peers[0], roomUpdateMessage)
+	assert.Equal(t, "owner-peer", room["owner"])
+	assert.Equal(t, "peer1", room["successor"])
+
+	// successor takes the room over when the owner disconnects
+	owner.Close()
+	room = readTypeWsT(t, peers[0], roomUpdateMessage)
+	assert.Equal(t, "peer1", room["owner"])
+
+	require.Nil(t, writeWsT(peers[1], transferOwnershipMessage, map[string]interface{}{"id": roomID, "peerId": "peer0"}))
+	room = readTypeWsT(t, peers[0], roomUpdateMessage)
+	assert.Equal(t, "peer0", room["owner"])
+}
+
+func TestPrivateRoom(t *testing.T) {
+	s, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	require.Nil(t, writeWsT(owner, createRoomMessage, map[string]interface{}{"settings": map[string]interface{}{"private": true}}))
+	room := readTypeWsT(t, owner, roomIsCreatedMessage)
+	roomID := room["id"].(string)
+
+	guest := dialWsT(t, s, "guest", "guest-peer")
+	defer guest.Close()
+	require.Nil(t, writeWsT(guest, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "guest-peer"}))
+	e := readTypeWsT(t, guest, errorMessage)
+	assert.Equal(t, codeInviteRequired, e["code"])
+	require.Nil(t, writeWsT(guest, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "guest-peer", "invite": "bad"}))
+	e = readTypeWsT(t, guest, errorMessage)
+	assert.Equal(t, codeInvalidInvite, e["code"])
+
+	invite, err := rooms.CreateInvite(roomID, "owner", 1, "participant")
+	require.Nil(t, err)
+	token, err := wsServer.auth.InviteToken(invite, time.Minute)
+	require.Nil(t, err)
+	require.Nil(t, writeWsT(guest, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "guest-peer", "invite": token}))
+	update := Room{}
+	require.Nil(t, json.Unmarshal(nextTypeWsT(t, guest, roomUpdateMessage).Data, &update))
+	require.Len(t, update.Users, 2)
+	assert.Equal(t, "participant", update.Users[1].Role)
+}
+
+func TestRoomPassword(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	require.Nil(t, writeWsT(owner, createRoomMessage, map[string]interface{}{"password": "secret", "settings": map[string]interface{}{"maxUsers": 2}}))
+	room := readTypeWsT(t, owner, roomIsCreatedMessage)
+	roomID := room["id"].(string)
+	assert.Equal(t, true, room["settings"].(map[string]interface{})["protected"])
+
+	guest := dialWsT(t, s, "guest", "guest-peer")
+	defer guest.Close()
+	require.Nil(t, writeWsT(guest, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "guest-peer", "password": "wrong"}))
+	e := readTypeWsT(t, guest, errorMessage)
+	assert.Equal(t, codeWrongPassword, e["code"])
+	require.Nil(t, writeWsT(guest, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "guest-peer", "password": "secret"}))
+	readTypeWsT(t, guest, roomUpdateMessage)
+
+	late := dialWsT(t, s, "late", "late-peer")
+	defer late.Close()
+	require.Nil(t, writeWsT(late, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "late-peer", "password": "secret"}))
+	e = readTypeWsT(t, late, errorMessage)
+	assert.Equal(t, codeRoomFull, e["code"])
+
+	require.Nil(t, writeWsT(late, createRoomMessage, map[string]interface{}{"settings": map[string]interface{}{"maxUsers": -1}}))
+	e = readTypeWsT(t, late, errorMessage)
+	assert.Equal(t, codeBadMessage, e["code"])
+}
+
+func TestModeration(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	peers := []*websocket.Conn{}
+	for i := 0; i < 2; i++ {
+		ws := dialWsT(t, s, fmt.Sprintf("user%d", i), fmt.Sprintf("peer%d", i))
+		defer ws.Close()
+		require.Nil(t, writeWsT(ws, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": fmt.Sprintf("peer%d", i)}))
+		readTypeWsT(t, ws, roomUpdateMessage)
+		peers = append(peers, ws)
+	}
+
+	require.Nil(t, writeWsT(peers[0], kickMessage, map[string]interface{}{"id": roomID, "peerId": "peer1"}))
+	e := readTypeWsT(t, peers[0], errorMessage)
+	assert.Equal(t, codeForbidden, e["code"])
+
+	require.Nil(t, writeWsT(owner, muteMessage, map[string]interface{}{"id": roomID, "peerId": "peer0", "media": []string{"chat"}, "muted": true}))
+	event := readTypeWsT(t, peers[0], moderationMessage)
+	assert.Equal(t, actionMute, event["action"])
+	require.Nil(t, writeWsT(peers[0], textMessage, map[string]interface{}{"id": roomID, "text": "hi"}))
+	e = readTypeWsT(t, peers[0], errorMessage)
+	assert.Equal(t, codeMuted, e["code"])
+	require.Nil(t, writeWsT(owner, muteMessage, map[string]interface{}{"id": roomID, "peerId": "peer0", "media": []string{"screen"}, "muted": true}))
+	e = readTypeWsT(t, owner, errorMessage)
+	assert.Equal(t, codeBadMessage, e["code"])
+
+	// banned peer is notified and cannot join again
+	require.Nil(t, writeWsT(owner, banMessage, map[string]interface{}{"id": roomID, "peerId": "peer1"}))
+	readTypeWsT(t, peers[1], moderationMessage) // mute of peer0
+	event = readTypeWsT(t, peers[1], moderationMessage)
+	assert.Equal(t, actionBan, event["action"])
+	assert.Equal(t, "user1", event["userId"])
+	room := Room{}
+	require.Nil(t, json.Unmarshal(nextTypeWsT(t, peers[0], roomUpdateMessage).Data, &room))
+	assert.False(t, hasUser(room.Users, "peer1"))
+	require.Nil(t, writeWsT(peers[1], joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer1"}))
+	e = readTypeWsT(t, peers[1], errorMessage)
+	assert.Equal(t, codeBanned, e["code"])
+}
+
+func TestMutedMedia(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	peer := dialWsT(t, s, "user", "peer")
+	defer peer.Close()
+	require.Nil(t, writeWsT(peer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer"}))
+	readTypeWsT(t, peer, roomUpdateMessage)
+
+	require.Nil(t, writeWsT(owner, muteMessage, map[string]interface{}{"id": roomID, "peerId": "peer", "media": []string{"audio"}, "muted": true}))
+	readTypeWsT(t, peer, moderationMessage)
+	offer := "v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=sendrecv\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=sendrecv\r\n"
+	require.Nil(t, writeToWsT(peer, sdpMessage, map[string]interface{}{"type": "offer", "sdp": offer}, "owner-peer"))
+	e := readTypeWsT(t, peer, errorMessage)
+	assert.Equal(t, codeForbidden, e["code"])
+	// muted media may be received
+	video := "v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=recvonly\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=sendrecv\r\n"
+	require.Nil(t, writeToWsT(peer, sdpMessage, map[string]interface{}{"type": "offer", "sdp": video}, "owner-peer"))
+	assert.Equal(t, video, readTypeWsT(t, owner, sdpMessage)["sdp"])
+
+	require.Nil(t, writeWsT(owner, muteMessage, map[string]interface{}{"id": roomID, "peerId": "peer", "media": []string{"audio"}, "muted": false}))
+	readTypeWsT(t, peer, moderationMessage)
+	require.Nil(t, writeToWsT(peer, sdpMessage, map[string]interface{}{"type": "offer", "sdp": offer}, "owner-peer"))
+	assert.Equal(t, offer, readTypeWsT(t, owner, sdpMessage)["sdp"])
+}
+
+func TestChatEdit(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	peer := dialWsT(t, s, "user", "peer")
+	defer peer.Close()
+	require.Nil(t, writeWsT(peer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "peer"}))
+	readTypeWsT(t, peer, roomUpdateMessage)
+
+	require.Nil(t, writeWsT(peer, textMessage, map[string]interface{}{"id": roomID, "text": "hi"}))
+	text := readTypeWsT(t, owner, textMessage)
+	id := text["id"]
+	assert.Equal(t, "user", text["authorId"])
+	require.Nil(t, writeWsT(owner, editMessage, map[string]interface{}{"id": roomID, "messageId": id, "text": "bye"}))
+	e := readTypeWsT(t, owner, errorMessage)
+	assert.Equal(t, codeForbidden, e["code"])
+	require.Nil(t, writeWsT(peer, editMessage, map[string]interface{}{"id": roomID, "messageId": 100, "text": "bye"}))
+	e = readTypeWsT(t, peer, errorMessage)
+	assert.Equal(t, codeMessageNotFound, e["code"])
+
+	require.Nil(t, writeWsT(peer, editMessage, map[string]interface{}{"id": roomID, "messageId": id, "text": "bye"}))
+	edited := readTypeWsT(t, owner, editMessage)
+	assert.Equal(t, id, edited["id"])
+	assert.Equal(t, "bye", edited["text"])
+	assert.NotEmpty(t, edited["edited"])
+
+	require.Nil(t, writeWsT(owner, textMessage, map[string]interface{}{"id": roomID, "text": "reply", "replyTo": id}))
+	reply := readTypeWsT(t, peer, textMessage)
+	assert.Equal(t, id, reply["replyTo"])
+	require.Nil(t, writeWsT(owner, reactionMessage, map[string]interface{}{"id": roomID, "messageId": id, "emoji": "👍"}))
+	reaction := readTypeWsT(t, peer, reactionMessage)
+	assert.Equal(t, map[string]interface{}{"roomId": roomID, "messageId": id, "emoji": "👍", "userId": "owner", "added": true}, reaction)
+
+	require.Nil(t, writeWsT(owner, deleteMessage, map[string]interface{}{"id": roomID, "messageId": id}))
+	deleted := readTypeWsT(t, peer, deleteMessage)
+	assert.Equal(t, id, deleted["messageId"])
+}
+
+func TestDirectMessage(t *testing.T) {
+	s, rooms, _, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	peers := []*websocket.Conn{}
+	for _, id := range []string{"a", "b"} {
+		ws := dialWsT(t, s, id, id+"-peer")
+		defer ws.Close()
+		require.Nil(t, writeWsT(ws, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": id + "-peer"}))
+		readTypeWsT(t, ws, roomUpdateMessage)
+		peers = append(peers, ws)
+	}
+	// other device of b is not in the room
+	device := dialWsT(t, s, "b", "b-device")
+	defer device.Close()
+
+	require.Nil(t, writeWsT(peers[0], textMessage, map[string]interface{}{"id": roomID, "text": "secret", "to": "b"}))
+	for _, ws := range []*websocket.Conn{peers[0], peers[1], device} {
+		direct := readTypeWsT(t, ws, textMessage)
+		assert.Equal(t, "secret", direct["text"])
+		assert.Equal(t, "b", direct["to"])
+	}
+	require.Nil(t, writeWsT(owner, textMessage, map[string]interface{}{"id": roomID, "text": "public"}))
+	// owner gets public message only
+	public := readTypeWsT(t, owner, textMessage)
+	assert.Equal(t, "public", public["text"])
+	assert.Len(t, rooms.GetRoom(roomID).Messages, 1)
+
+	require.Nil(t, writeWsT(peers[0], textMessage, map[string]interface{}{"id": roomID, "text": "secret", "to": "none"}))
+	e := readTypeWsT(t, peers[0], errorMessage)
+	assert.Equal(t, codeNotMember, e["code"])
+}
+
+func TestUserPeersIndex(t *testing.T) {
+	s, _, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	wsServer.ResumeGrace = 0
+
+	laptop := dialWsT(t, s, "user", "laptop")
+	defer laptop.Close()
+	phone := dialWsT(t, s, "user", "phone")
+	other := dialWsT(t, s, "other", "other-peer")
+	defer other.Close()
+	assert.Equal(t, []string{"laptop", "phone"}, wsServer.peersOf("user"))
+
+	phone.Close()
+	require.Eventually(t, func() bool { return len(wsServer.peersOf("user")) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"laptop"}, wsServer.peersOf("user"))
+	assert.Empty(t, wsServer.peersOf("none"))
+}
+
+func TestAuthorize(t *testing.T) {
+	_, rooms, wsServer, teardown := startupWsT(t)
+	defer teardown()
+	room, _ := rooms.CreateRoom(User{ID: "owner", PeerID: "owner-peer"}, RoomSettings{}, "")
+	rooms.JoinToRoom(room.ID, User{ID: "viewer", PeerID: "viewer-peer"}, "")
+	rooms.SetRole(room.ID, "owner", "viewer-peer", roleViewer)
+	viewer := User{ID: "viewer", PeerID: "viewer-peer"}
+	authorize := func(user User, messageType int, data map[string]interface{}) error {
+		return wsServer.authorize(user, &Message{Type: messageType, Data: composeData(data)})
+	}
+
+	err := authorize(viewer, textMessage, map[string]interface{}{"id": room.ID, "text": "hi"})
+	require.NotNil(t, err)
+	assert.Equal(t, codeForbidden, err.(*ProtocolError).Code)
+	err = authorize(viewer, addFakeUser, map[string]interface{}{"roomId": room.ID, "id": "fake"})
+	require.NotNil(t, err)
+	assert.Equal(t, codeForbidden, err.(*ProtocolError).Code)
+	err = authorize(viewer, transferOwnershipMessage, map[string]interface{}{"id": room.ID, "peerId": "viewer-peer"})
+	require.NotNil(t, err)
+	assert.Equal(t, codeNotOwner, err.(*ProtocolError).Code)
+	// not listed messages, missing rooms and non members are left to handlers
+	assert.Nil(t, authorize(viewer, leaveRoomMessage, map[string]interface{}{"id": room.ID}))
+	assert.Nil(t, authorize(viewer, textMessage, map[string]interface{}{"id": "none", "text": "hi"}))
+	assert.Nil(t, authorize(User{ID: "other"}, textMessage, map[string]interface{}{"id": room.ID, "text": "hi"}))
+	assert.Nil(t, authorize(User{ID: "owner"}, kickMessage, map[string]interface{}{"id": room.ID, "peerId": "viewer-peer"}))
+}
+
+func TestViewerRole(t *testing.T) {
+	s, rooms, _, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	roomID := createRoomT(t, owner)
+	viewer := dialWsT(t, s, "viewer", "viewer-peer")
+	defer viewer.Close()
+	require.Nil(t, writeWsT(viewer, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": "viewer-peer"}))
+	readTypeWsT(t, viewer, roomUpdateMessage)
+
+	require.Nil(t, writeWsT(viewer, setRoleMessage, map[string]interface{}{"id": roomID, "peerId": "viewer-peer", "role": "moderator"}))
+	e := readTypeWsT(t, viewer, errorMessage)
+	assert.Equal(t, codeForbidden, e["code"])
+	require.Nil(t, writeWsT(owner, setRoleMessage, map[string]interface{}{"id": roomID, "peerId": "viewer-peer", "role": "viewer"}))
+	room := Room{}
+	require.Nil(t, json.Unmarshal(nextTypeWsT(t, viewer, roomUpdateMessage).Data, &room))
+	assert.Equal(t, roleViewer, peerRole(&room, "viewer-peer"))
+	assert.Equal(t, roleViewer, peerRole(rooms.GetRoom(roomID), "viewer-peer"))
+
+	require.Nil(t, writeWsT(viewer, textMessage, map[string]interface{}{"id": roomID, "text": "hi"}))
+	e = readTypeWsT(t, viewer, errorMessage)
+	assert.Equal(t, codeForbidden, e["code"])
+
+	offer := "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=sendrecv\r\n"
+	require.Nil(t, writeToWsT(viewer, sdpMessage, map[string]interface{}{"type": "answer", "sdp": offer}, "owner-peer"))
+	e = readTypeWsT(t, viewer, errorMessage)
+	assert.Equal(t, codeForbidden, e["code"])
+	answer := "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=recvonly\r\n"
+	require.Nil(t, writeToWsT(viewer, sdpMessage, map[string]interface{}{"type": "answer", "sdp": answer}, "owner-peer"))
+	sdp := readTypeWsT(t, owner, sdpMessage)
+	assert.Equal(t, answer, sdp["sdp"])
+}
+
+func TestLobbyKnock(t *testing.T) {
+	s, _, _, teardown := startupWsT(t)
+	defer teardown()
+
+	owner := dialWsT(t, s, "owner", "owner-peer")
+	defer owner.Close()
+	require.Nil(t, writeWsT(owner, createRoomMessage, map[string]interface{}{"settings": map[string]interface{}{"lobby": true, "topology": "mesh"}}))
+	roomID := readTypeWsT(t, owner, roomIsCreatedMessage)["id"].(string)
+
+	guests := []*websocket.Conn{}
+	for i := 0; i < 2; i++ {
+		ws := dialWsT(t, s, fmt.Sprintf("guest%d", i), fmt.Sprintf("guest-peer%d", i))
+		defer ws.Close()
+		require.Nil(t, writeWsT(ws, joinRoomMessage, map[string]interface{}{"id": roomID, "peerId": fmt.Sprintf("guest-peer%d", i)}))
+		lobby := LobbyPayload{}
+		require.Nil(t, json.Unmarshal(nextTypeWsT(t, ws, lobbyMessage).Data, &lobby))
+		assert.Equal(t, lobbyWaiting, lobby.State)
+		// owner is notified with user info
+		require.Nil(t, json.Unmarshal(nextTypeWsT(t, owner, lobbyMessage).Data, &lobby))
+		assert.Equal(t, LobbyPayload{RoomID: roomID, State: lobbyWaiting, User: User{ID: fmt.Sprintf("guest%d", i), PeerID: fmt.Sprintf("guest-peer%d", i),
+			PictureURL: fmt.Sprintf("/avatar/guest%d", i)}}, lobby)
+		guests = append(guests, ws)
+	}
+
+	require.Nil(t, writeWsT(guests[0], admitMessage, map[string]interface{}{"id": roomID, "peerId": "guest-peer1"}))
+	e := readTypeWsT(t, guests[0], errorMessage)
+	assert.Equal(t, codeForbidden, e["code"])
+
+	require.Nil(t, writeWsT(owner, admitMessage, map[string]interface{}{"id": roomID, "peerId": "guest-peer0"}))
+	state := readTypeWsT(t, guests[0], lobbyMessage)
+	assert.Equal(t, lobbyAdmitted, state["state"])
+	room := readTypeWsT(t, guests[0], roomUpdateMessage)
+	assert.Len(t, room["users"], 2)
+	// lobby is sent to managers only
+	assert.NotContains(t, room, "pending")
+	assert.Len(t, readTypeWsT(t, owner, roomUpdateMessage)["pending"], 1)
+	start := readTypeWsT(t, guests[0], startPeerConnectionMessage)
+	assert.Equal(t, "owner-peer", start["peerId"])
+
+	require.Nil(t, writeWsT(owner, denyMessage, map[string]interface{}{"id": roomID, "peerId": "guest-peer1"}))
+	state = readTypeWsT(t, guests[1], lobbyMessage)
+	assert.Equal(t, lobbyDenied, state["state"])
+	// denied peer got no room updates
+	guests[1].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := guests[1].ReadMessage()
+	assert.NotNil(t, err)
+}
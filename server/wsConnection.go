@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pkg/errors"
+)
+
+// OverflowPolicy defines what to do with a peer which does not read its messages fast enough
+type OverflowPolicy int
+
+const (
+	// DropOnOverflow drops new messages while the peer queue is full
+	DropOnOverflow OverflowPolicy = iota
+	// DisconnectOnOverflow closes connection of the peer with full queue
+	DisconnectOnOverflow
+)
+
+// WsStats outbound traffic counters
+type WsStats struct {
+	Sent      uint64 `json:"sent"`      // messages written to sockets
+	Dropped   uint64 `json:"dropped"`   // messages dropped because of full queue
+	Evicted   uint64 `json:"evicted"`   // connections closed because of full queue or failed write
+	Throttled uint64 `json:"throttled"` // ephemeral events rejected by rate limit
+}
+
+// WS is websocket connection
+// all messages go through the bounded queue and are written by the connection own writer goroutine,
+// the writer also pings the peer, so the reader can detect dead peers by idle deadline
+type WS struct {
+	Conn      net.Conn
+	ID        string
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	wmu       sync.Mutex // serializes frames of the writer and control frame replies of the reader
+	dropped   uint64
+	version   int      // negotiated protocol version, used by reader only
+	events    throttle // ephemeral events limit, used by reader only
+}
+
+var errMessageTooLarge = errors.New("message is too large")
+
+func newWS(conn net.Conn, id string, queueSize int) *WS {
+	return &WS{
+		Conn:    conn,
+		ID:      id,
+		queue:   make(chan []byte, queueSize),
+		done:    make(chan struct{}),
+		version: legacyProtocolVersion,
+	}
+}
+
+// writeLoop writes queued messages and pings until connection is closed, zero pingInterval disables pings
+func (c *WS) writeLoop(timeout, pingInterval time.Duration, stats *WsStats) {
+	var ping <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		var err error
+		select {
+		case bts := <-c.queue:
+			if err = c.writeFrame(ws.OpBinary, bts, timeout); err == nil {
+				atomic.AddUint64(&stats.Sent, 1)
+			}
+		case <-ping:
+			err = c.writeFrame(ws.OpPing, nil, timeout)
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			select {
+			case <-c.done: // closed by reader or by overflow policy
+			default:
+				atomic.AddUint64(&stats.Evicted, 1)
+				c.close()
+			}
+			return
+		}
+	}
+}
+
+func (c *WS) writeFrame(op ws.OpCode, p []byte, timeout time.Duration) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return wsutil.WriteServerMessage(c.Conn, op, p)
+}
+
+func (c *WS) writeRaw(p []byte, timeout time.Duration) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := c.Conn.Write(p)
+	return err
+}
+
+// read returns next data message, any frame from the peer (pong as well) extends idle deadline,
+// so the read fails with timeout if the peer does not answer pings, zero idleTimeout disables deadline,
+// message larger than maxSize is skipped with errMessageTooLarge
+func (c *WS) read(idleTimeout, writeTimeout time.Duration, maxSize int64) ([]byte, error) {
+	handleControl := func(hdr ws.Header, r io.Reader) error {
+		reply := &bytes.Buffer{}
+		err := wsutil.ControlFrameHandler(reply, ws.StateServerSide)(hdr, r)
+		if reply.Len() > 0 {
+			if werr := c.writeRaw(reply.Bytes(), writeTimeout); err == nil {
+				err = werr
+			}
+		}
+		return err
+	}
+	rd := wsutil.Reader{
+		Source:         c.Conn,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		OnIntermediate: handleControl,
+	}
+	for {
+		if idleTimeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := handleControl(hdr, &rd); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if hdr.OpCode&(ws.OpText|ws.OpBinary) == 0 {
+			if err := rd.Discard(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if maxSize <= 0 {
+			return ioutil.ReadAll(&rd)
+		}
+		bts, err := ioutil.ReadAll(io.LimitReader(&rd, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(bts)) > maxSize {
+			if _, err := io.Copy(ioutil.Discard, &rd); err != nil {
+				return nil, err
+			}
+			return nil, errMessageTooLarge
+		}
+		return bts, nil
+	}
+}
+
+// push puts message to the queue, it never blocks
+func (c *WS) push(bts []byte, policy OverflowPolicy, stats *WsStats) error {
+	select {
+	case <-c.done:
+		return errors.Errorf("connection %s is closed", c.ID)
+	default:
+	}
+	select {
+	case c.queue <- bts:
+		return nil
+	default:
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	atomic.AddUint64(&stats.Dropped, 1)
+	if policy == DisconnectOnOverflow {
+		atomic.AddUint64(&stats.Evicted, 1)
+		c.close()
+		return errors.Errorf("connection %s is evicted, queue is full", c.ID)
+	}
+	return errors.Errorf("message to %s is dropped, queue is full", c.ID)
+}
+
+// closeWith sends close frame with the reason to the peer and closes connection
+func (c *WS) closeWith(code ws.StatusCode, reason string, timeout time.Duration) {
+	c.writeFrame(ws.OpClose, ws.NewCloseFrameBody(code, reason), timeout)
+	c.close()
+}
+
+// close stops writer and closes socket, reader loop gets an error and cleans up the connection
+func (c *WS) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+}
+
+// Dropped returns number of messages dropped for the connection
+func (c *WS) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowConsumerDrop(t *testing.T) {
+	stats := WsStats{}
+	server, client := net.Pipe() // nobody reads from the client side, so writes are stalled
+	defer client.Close()
+	conn := newWS(server, "slow", 2)
+	go conn.writeLoop(time.Minute, 0, &stats)
+	defer conn.close()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		conn.push([]byte("test"), DropOnOverflow, &stats)
+	}
+	assert.True(t, time.Since(start) < time.Second)
+	// one message is taken by the stalled writer, two are in the queue
+	assert.True(t, conn.Dropped() >= 7)
+	assert.Equal(t, conn.Dropped(), atomic.LoadUint64(&stats.Dropped))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&stats.Evicted))
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	stats := WsStats{}
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newWS(server, "slow", 1)
+	go conn.writeLoop(time.Minute, 0, &stats)
+
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		err = conn.push([]byte("test"), DisconnectOnOverflow, &stats)
+	}
+	require.Error(t, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&stats.Evicted))
+	select {
+	case <-conn.done:
+	default:
+		t.Fatal("connection is not closed")
+	}
+	assert.Error(t, conn.push([]byte("test"), DisconnectOnOverflow, &stats))
+}
+
+func TestWriteTimeout(t *testing.T) {
+	stats := WsStats{}
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newWS(server, "slow", 1)
+	go conn.writeLoop(50*time.Millisecond, 0, &stats)
+
+	require.NoError(t, conn.push([]byte("test"), DropOnOverflow, &stats))
+	select {
+	case <-conn.done:
+	case <-time.After(time.Second):
+		t.Fatal("stalled connection is not closed")
+	}
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&stats.Evicted))
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/google/uuid"
+)
+
+// DuplicatePolicy defines what to do when a socket id is connected already by the same user,
+// socket id of another user is always rejected
+type DuplicatePolicy int
+
+const (
+	// RejectDuplicate closes the new connection
+	RejectDuplicate DuplicatePolicy = iota
+	// KickPrevious closes the previous connection, the new one takes over the session
+	KickPrevious
+)
+
+// close codes sent to peers, see closeError
+const (
+	closeIDInUse  ws.StatusCode = 4001 // socket id is connected already
+	closeReplaced ws.StatusCode = 4002 // connection is replaced by a new one with the same socket id
+	closeIDTaken  ws.StatusCode = 4003 // socket id belongs to another user
+)
+
+// closeError is a reason to refuse connection, it is sent to the peer in close frame
+type closeError struct {
+	code   ws.StatusCode
+	reason string
+}
+
+func (e closeError) Error() string {
+	return e.reason
+}
+
+var (
+	errIDInUse = closeError{closeIDInUse, "socket id is already connected"}
+	errIDTaken = closeError{closeIDTaken, "socket id belongs to another user"}
+)
+
+// session keeps socket id, user and room membership between reconnects of the peer
+type session struct {
+	id      string // socket id
+	token   string // resume token, known only to the peer
+	user    User
+	conn    *WS      // nil while the peer is reconnecting
+	pending [][]byte // messages to the peer while it is reconnecting
+	caps    []string // capabilities negotiated in hello
+	timer   *time.Timer
+}
+
+// attach registers connection for the socket id, the previous session of the same user is resumed
+// if the resume token is valid, or it is taken over according to the duplicate policy,
+// session message with resume token and pending messages are queued before any other message
+func (s *WsServer) attach(user User, client *WS, resumeToken string) (*session, bool, error) {
+	var (
+		sess    *session
+		resumed bool
+		kicked  *WS
+	)
+	s.mu.Lock()
+	old := s.sessions[user.PeerID]
+	valid := old != nil && resumeToken != "" && old.user.ID == user.ID &&
+		subtle.ConstantTimeCompare([]byte(old.token), []byte(resumeToken)) == 1
+	if s.GenerateIDs && !valid {
+		// client id is accepted only to resume the session
+		user.PeerID = uuid.New().String()
+		old = nil
+	}
+	switch {
+	case old == nil:
+	case old.user.ID != user.ID:
+		s.mu.Unlock()
+		return nil, false, errIDTaken
+	case valid || (old.conn != nil && s.DuplicateIDs == KickPrevious):
+		if old.timer != nil {
+			old.timer.Stop()
+			old.timer = nil
+		}
+		resumed = old.conn == nil
+		kicked = old.conn
+		sess = old
+	case old.conn == nil:
+		// stale session leaves its rooms before the id is taken again,
+		// so cleanup by peer id cannot touch rooms of the new connection
+		old.timer.Stop()
+		s.removeSession(old)
+		s.mu.Unlock()
+		s.onCloseConnection(old.user)
+		return s.attach(user, client, resumeToken)
+	default:
+		s.mu.Unlock()
+		return nil, false, errIDInUse
+	}
+	if sess == nil {
+		sess = &session{id: user.PeerID, token: uuid.New().String(), user: user}
+		s.addSession(sess)
+	}
+	sess.conn = client
+	s.clients[sess.id] = client
+	data := composeData(SessionPayload{ID: sess.id, ResumeToken: sess.token, Resumed: sess == old})
+	bts, _ := json.Marshal(&Message{From: sess.id, Type: sessionMessage, Data: data, To: sess.id})
+	client.push(bts, s.OverflowPolicy, &s.stats)
+	for _, p := range sess.pending {
+		client.push(p, s.OverflowPolicy, &s.stats)
+	}
+	sess.pending = nil
+	s.mu.Unlock()
+
+	if kicked != nil {
+		kicked.closeWith(closeReplaced, "connection is replaced by a new one", s.WriteTimeout)
+	}
+	if resumed {
+		s.notifyPeerState(sess.user, "", peerReconnected)
+	}
+	return sess, sess == old, nil
+}
+
+// detach is called when connection is lost, peer keeps its rooms during grace period
+func (s *WsServer) detach(sess *session, client *WS) {
+	s.mu.Lock()
+	if sess.conn != client {
+		s.mu.Unlock()
+		return // session is resumed by another connection
+	}
+	sess.conn = nil
+	if s.sessions[sess.id] != sess {
+		s.mu.Unlock()
+		return // socket id is taken by another session
+	}
+	delete(s.clients, sess.id)
+	if s.ResumeGrace <= 0 {
+		s.removeSession(sess)
+		s.mu.Unlock()
+		s.onCloseConnection(sess.user)
+		return
+	}
+	sess.timer = time.AfterFunc(s.ResumeGrace, func() { s.expire(sess) })
+	s.mu.Unlock()
+	s.notifyPeerState(sess.user, peerReconnecting, peerReconnecting)
+}
+
+// expire removes session which is not resumed during grace period
+func (s *WsServer) expire(sess *session) {
+	s.mu.Lock()
+	if sess.conn != nil || s.sessions[sess.id] != sess {
+		s.mu.Unlock()
+		return
+	}
+	s.removeSession(sess)
+	s.mu.Unlock()
+	log.Printf("session %s is expired", sess.id)
+	s.onCloseConnection(sess.user)
+}
+
+// addSession registers session in sessions and userPeers, s.mu has to be locked
+func (s *WsServer) addSession(sess *session) {
+	s.sessions[sess.id] = sess
+	if s.userPeers[sess.user.ID] == nil {
+		s.userPeers[sess.user.ID] = map[string]bool{}
+	}
+	s.userPeers[sess.user.ID][sess.id] = true
+}
+
+// removeSession unregisters session, s.mu has to be locked
+func (s *WsServer) removeSession(sess *session) {
+	delete(s.sessions, sess.id)
+	delete(s.userPeers[sess.user.ID], sess.id)
+	if len(s.userPeers[sess.user.ID]) == 0 {
+		delete(s.userPeers, sess.user.ID)
+	}
+}
+
+// notifyPeerState sets peer state in its rooms and notifies other room peers
+func (s *WsServer) notifyPeerState(user User, state string, event string) {
+	data := composeData(PeerStatePayload{PeerID: user.PeerID, State: event})
+	for _, room := range s.rooms.SetPeerState(user.PeerID, state) {
+		s.sendToRoom(&room, &Message{From: user.PeerID, Type: peerStateMessage, Data: data, To: "all"}, user.PeerID)
+	}
+}
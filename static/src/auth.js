@@ -6,13 +6,7 @@ const getAuth = async () => {
   }
   const data = await res.json()
 
-  let avatar = ''
-  if (data.picture) {
-    avatar = 'data:image/png;base64,' + data.picture
-  }
-  if (data.pictureUrl) {
-    avatar = data.pictureUrl
-  }
+  const avatar = data.pictureUrl || ''
   const token = getJwt()
   return [token, { ...data, avatar }]
 }
@@ -123,9 +123,7 @@ export class Store {
   onUpdateRoom = async msg => {
     try {
       const { data } = msg
-      const users = data.users
-        .filter(user => user.peerId !== this.connectionId)
-        .map(user => ({ ...user, picture: user.pictureUrl || `data:image/png;base64,${user.picture}` }))
+      const users = data.users.filter(user => user.peerId !== this.connectionId)
       this.set({ room: data, messages: data.messages, users })
     } catch (e) {
       console.log('add peer error', e)
@@ -3,7 +3,7 @@ import { styleMap } from '../../libs/lit-html/directives/style-map.js'
 
 const User = (user, fakeUsers, store) => html`
   <div style=${styleMap(styles.user)}>
-    <img style=${styleMap(styles.avatar)} src=${user.picture} />
+    <img style=${styleMap(styles.avatar)} src=${user.pictureUrl} />
     <div style=${styleMap(styles.info)}>${user.name}</div>
     ${fakeUsers.includes(user.id) ?
     html`<button style=${styleMap(styles.closeUser)} @click=${() => store.dropClient(user.id)}>X</button>` :